@@ -0,0 +1,389 @@
+// Package auth manages the API keys and the control units that authorize the
+// requests to the device
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/internal/atomicfile"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.MustGetLogger("alisi")
+
+// the scopes an API key can be granted
+const (
+	ScopeClaimsWrite  = "claims:write"
+	ScopeClaimsDelete = "claims:delete"
+	ScopeKeysRotate   = "keys:rotate"
+
+	// ScopeAdmin grants every scope, and the management of the API keys
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists the scopes an API key can be granted
+var Scopes = []string{ScopeClaimsWrite, ScopeClaimsDelete, ScopeKeysRotate, ScopeAdmin}
+
+var (
+	// ErrInvalidKey means the API key is missing, unknown, revoked or expired
+	ErrInvalidKey = errors.New("API key is missing or invalid")
+
+	// ErrMissingScope means the API key or the bearer token is valid, but not
+	// granted the scope the request needs
+	ErrMissingScope = errors.New("not granted the scope")
+
+	// ErrKeyNotFound means no API key has the given ID
+	ErrKeyNotFound = errors.New("API key not found")
+
+	// ErrInvalidScope means the scope doesn't exist, or no scope is given
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// APIKey describes a key. Its secret is given once, when the key is created or
+// rotated: the registry keeps only its hash.
+type APIKey struct {
+	Id    string `json:"id"`
+	Label string `json:"label"`
+
+	Scopes []string `json:"scopes"`
+
+	// Unix time of the creation, or of the last rotation
+	CreatedAt int64 `json:"createdAt"`
+
+	// Unix time since the key is refused, never if zero
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	// Hash is the base64url SHA-256 digest of the secret. It's not sent by the API
+	Hash string `json:"hash,omitempty"`
+}
+
+// Allows tells if the key is granted the scope. An empty scope only needs a valid key
+func (k APIKey) Allows(scope string) bool {
+	return allows(k.Scopes, scope)
+}
+
+// allows tells if the granted scopes include the scope, or admin
+func allows(granted []string, scope string) bool {
+	for _, item := range granted {
+		if item == scope || item == ScopeAdmin {
+			return true
+		}
+	}
+	return scope == ""
+}
+
+// IssuedKey is a key with its token, handed to the client once
+type IssuedKey struct {
+	APIKey
+
+	// Token is the value of X-API-Key: the key ID and the secret
+	Token string `json:"token"`
+}
+
+// public returns the key without its hash
+func (k APIKey) public() APIKey {
+	k.Hash = ""
+	return k
+}
+
+// KeyRegistry holds the API keys, persisted as a JSON file readable by the owner only.
+// The file is read again once changed by another process, like the CLI commands.
+type KeyRegistry struct {
+	mutex sync.RWMutex
+	path  string
+	keys  map[string]APIKey
+
+	// modTime and size of the file when last read or written, to tell its changes
+	modTime time.Time
+	size    int64
+}
+
+// registry authorizes the requests. It starts empty, refusing every key
+var registry = NewKeyRegistry()
+
+// UseKeyRegistry selects the registry the requests are authorized against
+func UseKeyRegistry(keys *KeyRegistry) {
+	registry = keys
+}
+
+// Keys returns the registry the requests are authorized against
+func Keys() *KeyRegistry {
+	return registry
+}
+
+// NewKeyRegistry creates an empty registry, kept in memory only
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{keys: map[string]APIKey{}}
+}
+
+// OpenKeyRegistry loads the registry saved in the file, that is created
+// on the first change if it doesn't exist
+func OpenKeyRegistry(path string) (keys *KeyRegistry, err error) {
+	keys = NewKeyRegistry()
+	keys.path = path
+	if err = keys.load(); err != nil {
+		return nil, err
+	}
+	if keys.modTime.IsZero() {
+		log.Infof("no API keys in %s", path)
+	}
+	return
+}
+
+// refresh reads the file again if it changed since it was last read or written,
+// so that the keys created or revoked by the CLI take effect right away
+func (r *KeyRegistry) refresh() {
+	if r.path == "" {
+		return
+	}
+	info, err := os.Stat(r.path)
+	r.mutex.RLock()
+	unchanged := err == nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size
+	r.mutex.RUnlock()
+	if unchanged {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err = r.load(); err != nil {
+		log.Errorf("API keys not reloaded: %s", err)
+	}
+}
+
+// load reads the keys from the file, if it changed since it was last read or
+// written. Must be called holding the mutex for writing
+func (r *KeyRegistry) load() (err error) {
+	if r.path == "" {
+		return
+	}
+	info, err := os.Stat(r.path)
+	if os.IsNotExist(err) {
+		// a removed file revokes every key
+		if !r.modTime.IsZero() {
+			r.keys = map[string]APIKey{}
+			r.modTime, r.size = time.Time{}, 0
+		}
+		return nil
+	}
+	if err != nil || (info.ModTime().Equal(r.modTime) && info.Size() == r.size) {
+		return
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return
+	}
+	var stored []APIKey
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("invalid API key registry %s: %w", r.path, err)
+	}
+	keys := make(map[string]APIKey, len(stored))
+	for _, key := range stored {
+		keys[key.Id] = key
+	}
+	r.keys = keys
+	r.modTime, r.size = info.ModTime(), info.Size()
+	log.Infof("%d API keys loaded from %s", len(stored), r.path)
+	return
+}
+
+// Create adds a key granted the scopes, expiring at the unix time expiresAt
+// or never if zero
+func (r *KeyRegistry) Create(label string, scopes []string, expiresAt int64) (issued IssuedKey, err error) {
+	if err = checkScopes(scopes); err != nil {
+		return
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return
+	}
+	issued, err = r.store(APIKey{Id: id, Label: label, Scopes: scopes, ExpiresAt: expiresAt})
+	if err == nil {
+		log.Infof("API key %s (%s) created with scopes %v", id, label, scopes)
+	}
+	return
+}
+
+// Rotate gives the key a new secret, leaving the rest as it is. The old secret
+// is refused from now on.
+func (r *KeyRegistry) Rotate(id string) (issued IssuedKey, err error) {
+	r.refresh()
+	r.mutex.RLock()
+	key, ok := r.keys[id]
+	r.mutex.RUnlock()
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+		return
+	}
+	issued, err = r.store(key)
+	if err == nil {
+		log.Infof("API key %s (%s) rotated", id, key.Label)
+	}
+	return
+}
+
+// store saves the key with a new secret, and returns its token
+func (r *KeyRegistry) store(key APIKey) (issued IssuedKey, err error) {
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return
+	}
+	key.Hash = hash(secret)
+	key.CreatedAt = time.Now().Unix()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// the changes of other processes are kept
+	if err = r.load(); err != nil {
+		return
+	}
+	previous, existed := r.keys[key.Id]
+	r.keys[key.Id] = key
+	if err = r.save(); err != nil {
+		if existed {
+			r.keys[key.Id] = previous
+		} else {
+			delete(r.keys, key.Id)
+		}
+		return
+	}
+	return IssuedKey{APIKey: key.public(), Token: key.Id + "." + secret}, nil
+}
+
+// List returns the keys without their hash, sorted by ID
+func (r *KeyRegistry) List() []APIKey {
+	r.refresh()
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	keys := r.sorted()
+	for i := range keys {
+		keys[i] = keys[i].public()
+	}
+	return keys
+}
+
+// sorted lists the keys by ID. Must be called holding the mutex
+func (r *KeyRegistry) sorted() (keys []APIKey) {
+	keys = make([]APIKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Id < keys[j].Id
+	})
+	return
+}
+
+// Revoke deletes the key: its secret is refused from now on
+func (r *KeyRegistry) Revoke(id string) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err = r.load(); err != nil {
+		return
+	}
+	previous, ok := r.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	delete(r.keys, id)
+	if err = r.save(); err != nil {
+		r.keys[id] = previous
+		return
+	}
+	log.Infof("API key %s (%s) revoked", id, previous.Label)
+	return
+}
+
+// Authenticate returns the key the token belongs to, if it's valid now. The
+// token is made of the key ID and the secret: the ID is not secret, while the
+// hashes of the secrets are compared in constant time.
+func (r *KeyRegistry) Authenticate(token string) (key APIKey, err error) {
+	id, secret := token, ""
+	if dot := strings.IndexByte(token, '.'); dot >= 0 {
+		id, secret = token[:dot], token[dot+1:]
+	}
+	r.refresh()
+	r.mutex.RLock()
+	key, ok := r.keys[id]
+	r.mutex.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(key.Hash)) != 1 {
+		return APIKey{}, ErrInvalidKey
+	}
+	if key.ExpiresAt != 0 && time.Now().Unix() >= key.ExpiresAt {
+		return APIKey{}, fmt.Errorf("%w: key %s expired", ErrInvalidKey, id)
+	}
+	return key.public(), nil
+}
+
+// Authorize authenticates the token, and checks that its key is granted the scope
+func (r *KeyRegistry) Authorize(token string, scope string) (key APIKey, err error) {
+	key, err = r.Authenticate(token)
+	if err != nil {
+		return
+	}
+	if !key.Allows(scope) {
+		err = fmt.Errorf("%w %s", ErrMissingScope, scope)
+	}
+	return
+}
+
+// save writes the registry to its file, replacing it only once completely
+// written. Must be called holding the mutex
+func (r *KeyRegistry) save() (err error) {
+	if r.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(r.sorted(), "", "  ")
+	if err != nil {
+		return
+	}
+	if err = atomicfile.WriteFile(r.path, data); err != nil {
+		return
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return
+	}
+	r.modTime, r.size = info.ModTime(), info.Size()
+	return
+}
+
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: the key must be granted at least a scope", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, existing := range Scopes {
+			known = known || scope == existing
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+	}
+	return nil
+}
+
+// hash digests the secret. The secrets are random, so a plain SHA-256 is enough
+func hash(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func randomString(size int, encode func([]byte) string) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return encode(data), nil
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyRegistry(t *testing.T) {
+	registryPath := path.Join(t.TempDir(), "api_keys.json")
+	registry, err := OpenKeyRegistry(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Create("none", nil, 0); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("expected %v, got %v", ErrInvalidScope, err)
+	}
+	if _, err := registry.Create("root", []string{"root"}, 0); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("expected %v, got %v", ErrInvalidScope, err)
+	}
+	writer, err := registry.Create("writer", []string{ScopeClaimsWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := registry.Create("admin", []string{ScopeAdmin}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := registry.Create("expired", []string{ScopeAdmin}, time.Now().Unix()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the registry is readable by others: %v", info.Mode())
+	}
+	data, err := ioutil.ReadFile(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := strings.SplitN(writer.Token, ".", 2)[1]; strings.Contains(string(data), secret) {
+		t.Fatal("secret stored in clear")
+	}
+
+	cases := []struct {
+		name     string
+		token    string
+		scope    string
+		expected error
+	}{
+		{"granted", writer.Token, ScopeClaimsWrite, nil},
+		{"any valid key", writer.Token, "", nil},
+		{"not granted", writer.Token, ScopeClaimsDelete, ErrMissingScope},
+		{"admin", admin.Token, ScopeKeysRotate, nil},
+		{"wrong secret", writer.Id + ".wrong", "", ErrInvalidKey},
+		{"id only", writer.Id, "", ErrInvalidKey},
+		{"missing", "", "", ErrInvalidKey},
+		{"expired", expired.Token, "", ErrInvalidKey},
+	}
+	for _, c := range cases {
+		if _, err := registry.Authorize(c.token, c.scope); !errors.Is(err, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, err)
+		}
+	}
+
+	rotated, err := registry.Rotate(writer.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Id != writer.Id || rotated.Token == writer.Token || rotated.Scopes[0] != ScopeClaimsWrite {
+		t.Errorf("unexpected rotated key %+v", rotated)
+	}
+	if _, err := registry.Authenticate(writer.Token); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("old token accepted after the rotation: %v", err)
+	}
+	if err := registry.Revoke(admin.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Revoke(admin.Id); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	if _, err := registry.Rotate(admin.Id); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+
+	reopened, err := OpenKeyRegistry(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := reopened.List()
+	if len(keys) != 2 {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	for _, key := range keys {
+		if key.Hash != "" {
+			t.Errorf("hash of %s listed", key.Id)
+		}
+	}
+	if key, err := reopened.Authenticate(rotated.Token); err != nil || key.Label != "writer" {
+		t.Errorf("rotated key %+v not loaded: %v", key, err)
+	}
+	if _, err := reopened.Authenticate(admin.Token); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("revoked key accepted: %v", err)
+	}
+}
+
+func TestKeyRegistryReload(t *testing.T) {
+	registryPath := path.Join(t.TempDir(), "api_keys.json")
+	server, err := OpenKeyRegistry(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := server.Create("writer", []string{ScopeClaimsWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the CLI changes the file behind the back of the running server
+	cli, err := OpenKeyRegistry(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Revoke(writer.Id); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := cli.Create("admin", []string{ScopeAdmin}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Authenticate(writer.Token); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("key revoked by the CLI still accepted: %v", err)
+	}
+	if _, err := server.Authenticate(admin.Token); err != nil {
+		t.Errorf("key created by the CLI refused: %s", err)
+	}
+
+	// the changes of the server keep the ones of the CLI
+	if _, err = server.Create("reader", []string{ScopeClaimsDelete}, 0); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeyRegistry(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := reopened.List(); len(keys) != 2 {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	unitKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTrustStore([]ControlUnit{{Id: "unit", Scopes: []string{ScopeClaimsWrite}}}); err == nil {
+		t.Error("control unit without keys trusted")
+	}
+	if _, err := NewTrustStore([]ControlUnit{{Id: "unit", Keys: []string{"nope"}, Scopes: []string{ScopeClaimsWrite}}}); err == nil {
+		t.Error("control unit with an invalid key trusted")
+	}
+
+	storePath := path.Join(t.TempDir(), "control_units.json")
+	data, err := json.Marshal([]ControlUnit{{
+		Id:     "unit",
+		Keys:   []string{crypto.EncodePublicKeyToPem(unitKey.Public())},
+		Scopes: []string{ScopeClaimsWrite, ScopeClaimsDelete},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(storePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenTrustStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	token := func(key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+		encoded, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	valid := jwt.MapClaims{"iss": "unit", "aud": "did:key:device", "exp": now + 60, "scope": "claims:write"}
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	caller, err := store.Verify(token(unitKey, valid), []string{"did:key:device", "kid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Kind != CallerControlUnit || caller.Id != "unit" || !caller.Allows(ScopeClaimsWrite) || caller.Allows(ScopeClaimsDelete) {
+		t.Errorf("unexpected caller %+v", caller)
+	}
+	if _, err := store.Verify(token(unitKey, with("aud", []string{"other", "kid"})), []string{"did:key:device", "kid"}); err != nil {
+		t.Errorf("audience array refused: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+	}{
+		{"malformed", "not a token"},
+		{"unknown unit", token(unitKey, with("iss", "other"))},
+		{"wrong key", token(otherKey, valid)},
+		{"other device", token(unitKey, with("aud", "did:key:other"))},
+		{"no audience", token(unitKey, with("aud", nil))},
+		{"no exp", token(unitKey, with("exp", nil))},
+		{"expired", token(unitKey, with("exp", now-1))},
+		{"not valid yet", token(unitKey, with("nbf", now+60))},
+		{"scope not trusted", token(unitKey, with("scope", "claims:write admin"))},
+		{"scope not a string", token(unitKey, with("scope", []string{"claims:write"}))},
+	}
+	for _, c := range cases {
+		if _, err := store.Verify(c.token, []string{"did:key:device", "kid"}); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected %v, got %v", c.name, ErrInvalidToken, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	gocrypto "crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// the kinds of callers a request can be authorized for
+const (
+	CallerAPIKey      = "API key"
+	CallerControlUnit = "control unit"
+
+	// a TLS client whose certificate is not about a control unit
+	CallerCertificate = "client certificate"
+)
+
+// ErrInvalidToken means the bearer token is malformed, not signed by a trusted
+// control unit, meant for another device or expired
+var ErrInvalidToken = errors.New("bearer token is invalid")
+
+// Caller is the client a request is authorized for, named in the logs
+type Caller struct {
+	// Kind is CallerAPIKey or CallerControlUnit
+	Kind string
+	Id   string
+
+	Scopes []string
+}
+
+func (c Caller) String() string {
+	return c.Kind + " " + c.Id
+}
+
+// Allows tells if the caller is granted the scope. An empty scope only needs a valid caller
+func (c Caller) Allows(scope string) bool {
+	return allows(c.Scopes, scope)
+}
+
+// Caller returns the key as the caller of a request
+func (k APIKey) Caller() Caller {
+	return Caller{Kind: CallerAPIKey, Id: k.Id, Scopes: k.Scopes}
+}
+
+// ControlUnit is a client holding its own ALISI identity, that authorizes its
+// requests with bearer tokens: JWTs signed by one of its keys
+type ControlUnit struct {
+	// Id is the iss of the tokens of the control unit
+	Id string `json:"id"`
+
+	// Keys the tokens can be signed with: PEM, JWK or did:key
+	Keys []string `json:"keys"`
+
+	// Scopes the tokens of the control unit can grant at most
+	Scopes []string `json:"scopes"`
+}
+
+type trustedUnit struct {
+	ControlUnit
+	publicKeys []gocrypto.PublicKey
+}
+
+// TrustStore holds the control units trusted to sign bearer tokens. It's
+// configured with a JSON file, read once at startup.
+type TrustStore struct {
+	units map[string]trustedUnit
+}
+
+// trustStore authorizes the bearer tokens. It starts empty, refusing every token
+var trustStore = &TrustStore{units: map[string]trustedUnit{}}
+
+// UseTrustStore selects the control units the bearer tokens are verified against
+func UseTrustStore(store *TrustStore) {
+	trustStore = store
+}
+
+// ControlUnits returns the control units the bearer tokens are verified against
+func ControlUnits() *TrustStore {
+	return trustStore
+}
+
+// NewTrustStore checks the control units and trusts them
+func NewTrustStore(units []ControlUnit) (store *TrustStore, err error) {
+	store = &TrustStore{units: map[string]trustedUnit{}}
+	for _, unit := range units {
+		if unit.Id == "" {
+			return nil, errors.New("control unit without id")
+		}
+		if _, ok := store.units[unit.Id]; ok {
+			return nil, fmt.Errorf("control unit %s listed twice", unit.Id)
+		}
+		if err = checkScopes(unit.Scopes); err != nil {
+			return nil, fmt.Errorf("control unit %s: %w", unit.Id, err)
+		}
+		if len(unit.Keys) == 0 {
+			return nil, fmt.Errorf("control unit %s has no keys", unit.Id)
+		}
+		trusted := trustedUnit{ControlUnit: unit}
+		for _, key := range unit.Keys {
+			publicKey, err := crypto.DecodePublicKey(key)
+			if err != nil {
+				return nil, fmt.Errorf("control unit %s: invalid key: %w", unit.Id, err)
+			}
+			trusted.publicKeys = append(trusted.publicKeys, publicKey)
+		}
+		store.units[unit.Id] = trusted
+	}
+	return
+}
+
+// OpenTrustStore reads the control units from the file. A missing file trusts none
+func OpenTrustStore(path string) (store *TrustStore, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("no control units in %s", path)
+		return NewTrustStore(nil)
+	}
+	if err != nil {
+		return
+	}
+	var units []ControlUnit
+	if err = json.Unmarshal(data, &units); err != nil {
+		return nil, fmt.Errorf("invalid trust store %s: %w", path, err)
+	}
+	if store, err = NewTrustStore(units); err != nil {
+		return nil, fmt.Errorf("invalid trust store %s: %w", path, err)
+	}
+	log.Infof("%d control units loaded from %s", len(units), path)
+	return
+}
+
+// Verify checks the bearer token: it must be signed by a key of the control unit
+// in its iss, be meant for one of the audiences, carry an exp in the future and
+// grant in scope, space separated, only scopes the control unit is trusted with.
+func (t *TrustStore) Verify(token string, audiences []string) (caller Caller, err error) {
+	unverified, err := crypto.ReadJWT(token)
+	if err != nil {
+		return caller, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	iss, _ := unverified["iss"].(string)
+	unit, ok := t.units[iss]
+	if !ok {
+		return caller, fmt.Errorf("%w: unknown control unit %q", ErrInvalidToken, iss)
+	}
+	claims, err := unit.verify(token)
+	if err != nil {
+		return
+	}
+	if err = checkTimes(claims, time.Now().Unix()); err != nil {
+		return
+	}
+	if !hasAudience(claims, audiences) {
+		return caller, fmt.Errorf("%w: the audience is not this device", ErrInvalidToken)
+	}
+	scope, ok := claims["scope"].(string)
+	if _, present := claims["scope"]; present && !ok {
+		return caller, fmt.Errorf("%w: scope must be a string", ErrInvalidToken)
+	}
+	caller = Caller{Kind: CallerControlUnit, Id: unit.Id, Scopes: strings.Fields(scope)}
+	for _, granted := range caller.Scopes {
+		if !allows(unit.Scopes, granted) {
+			return Caller{}, fmt.Errorf("%w: control unit %s is not trusted with the scope %q", ErrInvalidToken, unit.Id, granted)
+		}
+	}
+	return
+}
+
+// CertificateCaller returns the caller of a client certificate, verified by the
+// TLS handshake. The certificate of a key of a control unit identifies it, with
+// all the scopes it's trusted with; other certificates are identified by their
+// subject, without scopes.
+func (t *TrustStore) CertificateCaller(certificate *x509.Certificate) Caller {
+	for _, unit := range t.units {
+		for _, publicKey := range unit.publicKeys {
+			if key, ok := publicKey.(interface{ Equal(gocrypto.PublicKey) bool }); ok && key.Equal(certificate.PublicKey) {
+				return Caller{Kind: CallerControlUnit, Id: unit.Id, Scopes: unit.Scopes}
+			}
+		}
+	}
+	return Caller{Kind: CallerCertificate, Id: certificate.Subject.String()}
+}
+
+// verify returns the claims of the token, if signed by a key of the control unit
+func (u trustedUnit) verify(token string) (claims jwt.MapClaims, err error) {
+	for _, publicKey := range u.publicKeys {
+		if claims, err = crypto.CheckJWTSignature(token, publicKey); err == nil {
+			return
+		}
+	}
+	return nil, fmt.Errorf("%w: not signed by a key of control unit %s", ErrInvalidToken, u.Id)
+}
+
+// checkTimes requires an exp after now, and a nbf not after it if present
+func checkTimes(claims jwt.MapClaims, now int64) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: exp must be a number", ErrInvalidToken)
+	}
+	if now >= int64(exp) {
+		return fmt.Errorf("%w: expired at %d", ErrInvalidToken, int64(exp))
+	}
+	if nbf, present := claims["nbf"]; present {
+		if nbf, ok := nbf.(float64); !ok || now < int64(nbf) {
+			return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+		}
+	}
+	return nil
+}
+
+// hasAudience tells if the aud of the token, a string or an array, names one of the audiences
+func hasAudience(claims jwt.MapClaims, audiences []string) bool {
+	var aud []string
+	switch value := claims["aud"].(type) {
+	case string:
+		aud = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			if item, ok := item.(string); ok {
+				aud = append(aud, item)
+			}
+		}
+	}
+	for _, item := range aud {
+		for _, audience := range audiences {
+			if item == audience && audience != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+package auth
+
+import "github.com/TeoSocs/alisi-client/config"
+
+// Configure loads the API keys and the control units of the settings
+func Configure(settings config.Auth) (err error) {
+	keys, err := OpenKeyRegistry(settings.APIKeys)
+	if err != nil {
+		return
+	}
+	units, err := OpenTrustStore(settings.ControlUnits)
+	if err != nil {
+		return
+	}
+	UseKeyRegistry(keys)
+	UseTrustStore(units)
+	return
+}
@@ -0,0 +1,336 @@
+// Package config holds the settings of the device. They are loaded from the
+// defaults, overlaid by a YAML file, by the environment and by the flags, in
+// this order of precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/op/go-logging"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the environment variables overlaying the flags: the flag
+// -claim-store is overlaid by ALISI_CLAIM_STORE
+const EnvPrefix = "ALISI_"
+
+// ErrInvalidConfig means a setting is missing or out of range
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Config holds all the settings of the device
+type Config struct {
+	// DataDir is the folder the relative paths are resolved in, the working
+	// directory if empty. Each instance on a gateway needs its own.
+	DataDir  string `yaml:"dataDir"`
+	LogLevel string `yaml:"logLevel"`
+
+	Server Server `yaml:"server"`
+	Keys   Keys   `yaml:"keys"`
+	Claims Claims `yaml:"claims"`
+	Auth   Auth   `yaml:"auth"`
+}
+
+// Server tells where and how the API is served
+type Server struct {
+	// Listen is the address of the API, as host:port
+	Listen string `yaml:"listen"`
+	TLS    TLS    `yaml:"tls"`
+}
+
+// TLS configures serving the API over TLS, with a certificate of the device key
+type TLS struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Chain is a PEM file with a certificate chain issued for the device key,
+	// served instead of the installed one
+	Chain string `yaml:"chain"`
+
+	// Hosts are the DNS names and IP addresses of the self-signed certificate
+	Hosts []string `yaml:"hosts"`
+
+	// ClientCA is a PEM bundle of the CAs the client certificates are verified
+	// against. Client certificates are not asked for if empty
+	ClientCA          string `yaml:"clientCA"`
+	RequireClientCert bool   `yaml:"requireClientCert"`
+}
+
+// Keys configures the keystore holding the device key
+type Keys struct {
+	// Store is the backend: file or memory
+	Store string `yaml:"store"`
+
+	// Folder of the file keystore
+	Folder string `yaml:"folder"`
+
+	// Name is the ID of the device key inside the keystore
+	Name string `yaml:"name"`
+
+	// Algorithm of newly created keys: ES256, ES384, ES512 or EdDSA
+	Algorithm string `yaml:"algorithm"`
+
+	// the source of the passphrase that encrypts the keystore, at most one.
+	// The file keystore needs one, unless AllowUnencrypted is set
+	PassphraseEnv    string `yaml:"passphraseEnv"`
+	PassphraseFD     int    `yaml:"passphraseFD"`
+	PassphrasePrompt bool   `yaml:"passphrasePrompt"`
+
+	// AllowUnencrypted stores the device key in clear when no passphrase is given
+	AllowUnencrypted bool `yaml:"allowUnencrypted"`
+
+	// DeterministicSignatures makes the ecdsa signatures RFC 6979 deterministic
+	// instead of randomized, for devices without a reliable random source
+	DeterministicSignatures bool `yaml:"deterministicSignatures"`
+}
+
+// Claims configures where the claims and the issuers are kept, and for how long
+type Claims struct {
+	// Store is the backend: dir, bolt or memory
+	Store string `yaml:"store"`
+
+	// Location is the folder of the dir store, or the database file of the bolt one
+	Location string `yaml:"location"`
+
+	Issuers     string `yaml:"issuers"`
+	Revocations string `yaml:"revocations"`
+
+	// HistoryVersions are kept for each claim, 0 keeps them all
+	HistoryVersions int `yaml:"historyVersions"`
+
+	// HistoryDays the versions are kept once replaced, and the tombstones once
+	// deleted. 0 keeps them for ever
+	HistoryDays int `yaml:"historyDays"`
+
+	// JanitorInterval is the time between two sweeps of the expired claims
+	JanitorInterval time.Duration `yaml:"janitorInterval"`
+}
+
+// Auth configures who can call the API
+type Auth struct {
+	APIKeys      string `yaml:"apiKeys"`
+	ControlUnits string `yaml:"controlUnits"`
+}
+
+// Default returns the settings used when nothing else is given
+func Default() Config {
+	return Config{
+		LogLevel: "INFO",
+		Server: Server{
+			Listen: ":8080",
+			TLS:    TLS{Hosts: []string{"localhost", "127.0.0.1"}},
+		},
+		Keys: Keys{
+			Store:        "file",
+			Folder:       "keys",
+			Name:         "private",
+			Algorithm:    "ES256",
+			PassphraseFD: -1,
+		},
+		Claims: Claims{
+			Store:           "dir",
+			Location:        "claims",
+			Issuers:         "issuers.json",
+			Revocations:     "revocations.json",
+			HistoryVersions: 10,
+			HistoryDays:     90,
+			JanitorInterval: time.Hour,
+		},
+		Auth: Auth{
+			APIKeys:      "api_keys.json",
+			ControlUnits: "control_units.json",
+		},
+	}
+}
+
+// RegisterFlags defines on fs a flag for each setting, bound to it
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "YAML file with the settings, overlaid by the environment and by the flags")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "folder the relative paths are resolved in")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "CRITICAL, ERROR, WARNING, NOTICE, INFO or DEBUG")
+
+	fs.StringVar(&c.Server.Listen, "listen", c.Server.Listen, "address the API is served on, as host:port")
+	fs.BoolVar(&c.Server.TLS.Enabled, "tls", c.Server.TLS.Enabled, "serve the API over TLS, with a certificate of the device key")
+	fs.StringVar(&c.Server.TLS.Chain, "tls-chain", c.Server.TLS.Chain, "PEM certificate chain issued by a CA for the device key, served instead of the installed one")
+	fs.Var((*listValue)(&c.Server.TLS.Hosts), "tls-hosts", "comma separated DNS names and IP addresses of the device certificate")
+	fs.StringVar(&c.Server.TLS.ClientCA, "client-ca", c.Server.TLS.ClientCA, "PEM bundle of the CAs the client certificates are verified against. Client certificates are not asked for if missing")
+	fs.BoolVar(&c.Server.TLS.RequireClientCert, "require-client-cert", c.Server.TLS.RequireClientCert, "refuse the TLS clients without a certificate issued by a CA of -client-ca")
+
+	fs.StringVar(&c.Keys.Store, "keystore", c.Keys.Store, "backend holding the device key: file or memory")
+	fs.StringVar(&c.Keys.Folder, "keys", c.Keys.Folder, "folder used by the file keystore")
+	fs.StringVar(&c.Keys.Name, "key", c.Keys.Name, "ID of the device key inside the keystore")
+	fs.StringVar(&c.Keys.Algorithm, "key-algorithm", c.Keys.Algorithm, "algorithm of newly created keys: ES256, ES384, ES512 or EdDSA")
+	fs.StringVar(&c.Keys.PassphraseEnv, "passphrase-env", c.Keys.PassphraseEnv, "environment variable holding the passphrase that encrypts the keystore")
+	fs.IntVar(&c.Keys.PassphraseFD, "passphrase-fd", c.Keys.PassphraseFD, "file descriptor to read the passphrase that encrypts the keystore from")
+	fs.BoolVar(&c.Keys.PassphrasePrompt, "passphrase-prompt", c.Keys.PassphrasePrompt, "prompt for the passphrase that encrypts the keystore")
+	fs.BoolVar(&c.Keys.AllowUnencrypted, "allow-unencrypted-key", c.Keys.AllowUnencrypted, "store the device key in clear when no passphrase is given, instead of refusing to start")
+	fs.BoolVar(&c.Keys.DeterministicSignatures, "deterministic-signatures", c.Keys.DeterministicSignatures, "sign with RFC 6979 deterministic ecdsa signatures instead of randomized ones")
+
+	fs.StringVar(&c.Claims.Store, "claim-store", c.Claims.Store, "backend holding the claims: dir, bolt or memory")
+	fs.StringVar(&c.Claims.Location, "claims", c.Claims.Location, "folder of the dir claim store, or database file of the bolt one")
+	fs.StringVar(&c.Claims.Issuers, "issuers", c.Claims.Issuers, "file holding the trusted issuers and their keys")
+	fs.StringVar(&c.Claims.Revocations, "revocations", c.Claims.Revocations, "file holding the revocation lists pushed by the issuers")
+	fs.IntVar(&c.Claims.HistoryVersions, "history-versions", c.Claims.HistoryVersions, "versions kept for each claim, deletions included. 0 keeps them all")
+	fs.IntVar(&c.Claims.HistoryDays, "history-days", c.Claims.HistoryDays, "days the replaced versions and the deleted claims are kept. 0 keeps them for ever")
+	fs.DurationVar(&c.Claims.JanitorInterval, "janitor-interval", c.Claims.JanitorInterval, "time between two sweeps of the expired claims and of the history")
+
+	fs.StringVar(&c.Auth.APIKeys, "api-keys", c.Auth.APIKeys, "file holding the hashes of the API keys")
+	fs.StringVar(&c.Auth.ControlUnits, "control-units", c.Auth.ControlUnits, "file holding the control units trusted to sign bearer tokens")
+}
+
+// Load overlays the settings with the file given by -config or ALISI_CONFIG,
+// then with the environment and then with the flags set on fs, that must be
+// parsed already. The result is validated, and its relative paths resolved.
+func (c *Config) Load(fs *flag.FlagSet) (err error) {
+	// the file and the environment overwrite the settings bound to the flags
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	file, ok := set["config"]
+	if !ok {
+		file = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if file != "" {
+		if err = c.ReadFile(file); err != nil {
+			return
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok || err != nil || f.Name == "config" {
+			return
+		}
+		if err = fs.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("%w: %s: %s", ErrInvalidConfig, EnvName(f.Name), err)
+		}
+	})
+	if err != nil {
+		return
+	}
+	for name, value := range set {
+		if err = fs.Set(name, value); err != nil {
+			return
+		}
+	}
+	if err = c.Validate(); err != nil {
+		return
+	}
+	c.resolvePaths()
+	return
+}
+
+// EnvName returns the environment variable overlaying the flag
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ReadFile overlays the settings with those of the YAML file. Unknown settings are refused.
+func (c *Config) ReadFile(file string) (err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// an empty file leaves the settings as they are
+	if err = decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, file, err)
+	}
+	return nil
+}
+
+// Validate makes sure every setting is usable. The errors wrap ErrInvalidConfig.
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	oneOf := func(name string, value string, allowed ...string) {
+		for _, item := range allowed {
+			if value == item {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s must be one of %s, not %q", name, strings.Join(allowed, ", "), value))
+	}
+
+	_, err := logging.LogLevel(c.LogLevel)
+	check(err == nil, "unknown log level %q", c.LogLevel)
+	_, _, err = net.SplitHostPort(c.Server.Listen)
+	check(err == nil, "listen must be host:port, not %q", c.Server.Listen)
+	check(!c.Server.TLS.RequireClientCert || c.Server.TLS.ClientCA != "", "client certificates are required, but no client CA is given")
+	check(!c.Server.TLS.Enabled || len(c.Server.TLS.Hosts) > 0, "the TLS certificate needs at least a host")
+
+	oneOf("keystore", c.Keys.Store, "file", "memory")
+	check(c.Keys.Store != "file" || c.Keys.Folder != "", "the file keystore needs a folder")
+	check(c.Keys.Name != "", "the device key needs a name")
+	oneOf("key algorithm", c.Keys.Algorithm, "ES256", "ES384", "ES512", "EdDSA")
+	sources := 0
+	for _, given := range []bool{c.Keys.PassphraseEnv != "", c.Keys.PassphraseFD >= 0, c.Keys.PassphrasePrompt} {
+		if given {
+			sources++
+		}
+	}
+	check(sources <= 1, "the passphrase can be read from one source only")
+
+	oneOf("claim store", c.Claims.Store, "dir", "bolt", "memory")
+	check(c.Claims.Store == "memory" || c.Claims.Location != "", "the claim store needs a location")
+	check(c.Claims.Issuers != "", "the issuers need a file")
+	check(c.Claims.Revocations != "", "the revocation lists need a file")
+	check(c.Claims.HistoryVersions >= 0, "history versions can't be negative")
+	check(c.Claims.HistoryDays >= 0, "history days can't be negative")
+	check(c.Claims.JanitorInterval > 0, "the janitor interval must be positive")
+
+	check(c.Auth.APIKeys != "", "the API keys need a file")
+	check(c.Auth.ControlUnits != "", "the control units need a file")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// resolvePaths makes the relative paths relative to DataDir
+func (c *Config) resolvePaths() {
+	if c.DataDir == "" {
+		return
+	}
+	for _, path := range []*string{
+		&c.Server.TLS.Chain, &c.Server.TLS.ClientCA, &c.Keys.Folder, &c.Claims.Location,
+		&c.Claims.Issuers, &c.Claims.Revocations, &c.Auth.APIKeys, &c.Auth.ControlUnits,
+	} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(c.DataDir, *path)
+		}
+	}
+}
+
+// listValue is a comma separated list flag
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// load registers the flags of a fresh configuration, parses args and loads it
+func load(t *testing.T, args ...string) (c Config, err error) {
+	c = Default()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	if err = fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Load(fs)
+	return
+}
+
+func writeFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "alisi.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDefault(t *testing.T) {
+	c, err := load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Fatalf("the defaults changed loading nothing:\n%+v", c)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, `
+logLevel: DEBUG
+server:
+  listen: ":8081"
+  tls:
+    enabled: true
+    hosts: [gateway.local]
+claims:
+  store: bolt
+  location: claims.db
+  janitorInterval: 10m
+`)
+	t.Setenv("ALISI_CONFIG", file)
+	t.Setenv("ALISI_LISTEN", ":8082")
+	t.Setenv("ALISI_TLS_HOSTS", "gateway.local, 10.0.0.2")
+	t.Setenv("ALISI_KEY", "device")
+
+	c, err := load(t, "-key", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file overlays the defaults
+	if c.LogLevel != "DEBUG" || !c.Server.TLS.Enabled || c.Claims.Store != "bolt" || c.Claims.JanitorInterval != 10*time.Minute {
+		t.Fatalf("file not loaded: %+v", c)
+	}
+	if c.Claims.HistoryDays != 90 {
+		t.Fatalf("default lost: %+v", c.Claims)
+	}
+	// the environment overlays the file
+	if c.Server.Listen != ":8082" {
+		t.Fatalf(":8082 expected, %s found", c.Server.Listen)
+	}
+	if !reflect.DeepEqual(c.Server.TLS.Hosts, []string{"gateway.local", "10.0.0.2"}) {
+		t.Fatalf("wrong hosts %v", c.Server.TLS.Hosts)
+	}
+	// the flags overlay the environment
+	if c.Keys.Name != "other" {
+		t.Fatalf("key other expected, %s found", c.Keys.Name)
+	}
+}
+
+func TestUnknownSetting(t *testing.T) {
+	file := writeFile(t, "server:\n  port: 8081\n")
+	if _, err := load(t, "-config", file); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("ErrInvalidConfig expected, %v found", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, change := range map[string]func(*Config){
+		"listen":         func(c *Config) { c.Server.Listen = "8080" },
+		"log level":      func(c *Config) { c.LogLevel = "LOUD" },
+		"keystore":       func(c *Config) { c.Keys.Store = "vault" },
+		"algorithm":      func(c *Config) { c.Keys.Algorithm = "RS256" },
+		"passphrases":    func(c *Config) { c.Keys.PassphraseEnv = "PASS"; c.Keys.PassphrasePrompt = true },
+		"claim store":    func(c *Config) { c.Claims.Store = "sql" },
+		"history":        func(c *Config) { c.Claims.HistoryVersions = -1 },
+		"janitor":        func(c *Config) { c.Claims.JanitorInterval = 0 },
+		"client CA":      func(c *Config) { c.Server.TLS.RequireClientCert = true },
+		"control units":  func(c *Config) { c.Auth.ControlUnits = "" },
+		"claim location": func(c *Config) { c.Claims.Location = "" },
+	} {
+		c := Default()
+		change(&c)
+		if err := c.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: ErrInvalidConfig expected, %v found", name, err)
+		}
+	}
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidEnvironment(t *testing.T) {
+	t.Setenv("ALISI_HISTORY_DAYS", "ninety")
+	if _, err := load(t); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("ErrInvalidConfig expected, %v found", err)
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	absolute := filepath.Join(t.TempDir(), "issuers.json")
+	c, err := load(t, "-data-dir", "/var/lib/alisi/2", "-issuers", absolute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Keys.Folder != "/var/lib/alisi/2/keys" || c.Claims.Location != "/var/lib/alisi/2/claims" {
+		t.Fatalf("paths not resolved in the data dir: %+v", c)
+	}
+	if c.Claims.Issuers != absolute {
+		t.Fatalf("absolute path changed to %s", c.Claims.Issuers)
+	}
+	if c.Server.TLS.Chain != "" {
+		t.Fatalf("empty path changed to %s", c.Server.TLS.Chain)
+	}
+}
@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Algorithm is the JWS name of a signature algorithm supported for the device key
+type Algorithm string
+
+const (
+	ES256 Algorithm = "ES256"
+	ES384 Algorithm = "ES384"
+	ES512 Algorithm = "ES512"
+	EdDSA Algorithm = "EdDSA"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+// keyAlgorithm is used to create new device keys, at first start and on rotation
+var keyAlgorithm = ES256
+
+// UseKeyAlgorithm selects the algorithm of the keys created from now on.
+// Existing keys keep their own algorithm.
+func UseKeyAlgorithm(alg Algorithm) (err error) {
+	if _, err = ParseAlgorithm(string(alg)); err != nil {
+		return
+	}
+	keyAlgorithm = alg
+	return
+}
+
+// ParseAlgorithm returns the Algorithm with the given JWS name
+func ParseAlgorithm(name string) (alg Algorithm, err error) {
+	switch alg = Algorithm(name); alg {
+	case ES256, ES384, ES512, EdDSA:
+		return
+	}
+	err = fmt.Errorf("unsupported algorithm %q", name)
+	return
+}
+
+func curveFor(alg Algorithm) (curve elliptic.Curve, err error) {
+	switch alg {
+	case ES256:
+		curve = elliptic.P256()
+	case ES384:
+		curve = elliptic.P384()
+	case ES512:
+		curve = elliptic.P521()
+	default:
+		err = fmt.Errorf("%q is not an ecdsa algorithm", alg)
+	}
+	return
+}
+
+// AlgorithmOf returns the algorithm matching the public key
+func AlgorithmOf(key gocrypto.PublicKey) (alg Algorithm, err error) {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return ES256, nil
+		case 384:
+			return ES384, nil
+		case 521:
+			return ES512, nil
+		}
+	case ed25519.PublicKey:
+		return EdDSA, nil
+	}
+	err = fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	return
+}
+
+func newPrivateKey(alg Algorithm) (privateKey gocrypto.Signer, err error) {
+	if alg == EdDSA {
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+		return
+	}
+	curve, err := curveFor(alg)
+	if err != nil {
+		return
+	}
+	return ecdsa.GenerateKey(curve, rand.Reader)
+}
+
+func signingMethodFor(key gocrypto.PublicKey) (method jwt.SigningMethod, err error) {
+	alg, err := AlgorithmOf(key)
+	if err != nil {
+		return
+	}
+	method = jwt.GetSigningMethod(string(alg))
+	return
+}
+
+// SigningMethodEdDSA implements the EdDSA JWS algorithm with Ed25519 keys,
+// that jwt-go doesn't provide
+type SigningMethodEdDSA struct{}
+
+var SigningMethodEd25519 = &SigningMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(string(EdDSA), func() jwt.SigningMethod {
+		return SigningMethodEd25519
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return string(EdDSA)
+}
+
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
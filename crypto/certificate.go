@@ -0,0 +1,322 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// validity of the self-signed certificates, made again at every start and rotation,
+// and once they are about to expire
+const (
+	selfSignedValidity    = 365 * 24 * time.Hour
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrNoCertificate means no certificate chain is installed for the current device key
+	ErrNoCertificate = errors.New("no certificate installed for the device key")
+
+	// ErrInvalidCertificate means the chain is malformed, doesn't certify the
+	// device key, or isn't signed in order
+	ErrInvalidCertificate = errors.New("invalid certificate chain")
+
+	// ErrInvalidCertificateName means a name requested for the certificate is malformed
+	ErrInvalidCertificateName = errors.New("invalid certificate name")
+)
+
+// chainVersion counts the chains installed, so that they are served right away
+var chainVersion int64
+
+// CertificateNames are the subject and the alternative names of the device
+// certificate. The DID of the device is always among the URIs.
+type CertificateNames struct {
+	// CommonName is the kid of the device key if empty
+	CommonName         string   `json:"commonName,omitempty"`
+	SerialNumber       string   `json:"serialNumber,omitempty"`
+	Organization       []string `json:"organization,omitempty"`
+	OrganizationalUnit []string `json:"organizationalUnit,omitempty"`
+	Locality           []string `json:"locality,omitempty"`
+	Country            []string `json:"country,omitempty"`
+
+	// Hosts are DNS names or IP addresses
+	Hosts  []string `json:"hosts,omitempty"`
+	URIs   []string `json:"uris,omitempty"`
+	Emails []string `json:"emails,omitempty"`
+}
+
+// DeviceCertificates provides the TLS certificate of the device key: the chain
+// issued by a CA for the key if given or installed, or a self-signed certificate
+// otherwise. The certificate follows the rotations of the key.
+type DeviceCertificates struct {
+	// Hosts are the DNS names and the IP addresses of the self-signed certificate
+	Hosts []string
+
+	// Chain is the DER certificate chain issued for the device key, leaf first.
+	// The installed chain is served if missing
+	Chain [][]byte
+
+	mutex        sync.Mutex
+	kid          string
+	chainVersion int64
+	certificate  *tls.Certificate
+
+	// renewAt is when the self-signed certificate is made again, zero for a chain
+	renewAt time.Time
+}
+
+// GetCertificate returns the certificate of the current key, as needed by tls.Config
+func (d *DeviceCertificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return d.Certificate()
+}
+
+// Certificate returns the certificate of the current key. The chain is served
+// only if its leaf certifies the key: after a rotation the certificate is
+// self-signed, until a chain is issued for the new key. The self-signed
+// certificate is made again selfSignedRenewBefore its expiry.
+func (d *DeviceCertificates) Certificate() (certificate *tls.Certificate, err error) {
+	// the device key is kept in memory: the keystore is read only on a change
+	privateKey, err := getPrivateKey()
+	if err != nil {
+		return
+	}
+	kid := KeyId(privateKey.Public())
+	version := atomic.LoadInt64(&chainVersion)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.kid == kid && d.chainVersion == version && (d.renewAt.IsZero() || time.Now().Before(d.renewAt)) {
+		return d.certificate, nil
+	}
+	chain := d.Chain
+	if len(chain) > 0 {
+		if err = CheckCertificateChain(chain, privateKey.Public()); err != nil {
+			log.Printf("serving a self-signed certificate, the chain doesn't certify key %s: %s", kid, err)
+			chain = nil
+		}
+	} else if chain, err = CertificateChain(); errors.Is(err, ErrNoCertificate) {
+		chain = nil
+	} else if err != nil {
+		return
+	}
+	selfSigned := len(chain) == 0
+	if selfSigned {
+		var leaf []byte
+		if leaf, err = selfSignedCertificate(privateKey, CertificateNames{Hosts: d.Hosts}); err != nil {
+			return
+		}
+		chain = [][]byte{leaf}
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return
+	}
+	d.renewAt = time.Time{}
+	if selfSigned {
+		d.renewAt = leaf.NotAfter.Add(-selfSignedRenewBefore)
+	}
+	d.certificate = &tls.Certificate{Certificate: chain, PrivateKey: privateKey, Leaf: leaf}
+	d.kid = kid
+	d.chainVersion = version
+	log.Printf("TLS certificate of key %s issued by %s", kid, leaf.Issuer)
+	return d.certificate, nil
+}
+
+// CheckCertificateChain makes sure the leaf of the chain certifies the public
+// key, and each certificate is signed by the next one. The errors wrap ErrInvalidCertificate.
+func CheckCertificateChain(chain [][]byte, publicKey gocrypto.PublicKey) (err error) {
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: no certificates", ErrInvalidCertificate)
+	}
+	certificates := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		if certificates[i], err = x509.ParseCertificate(der); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidCertificate, err)
+		}
+	}
+	leafKey, ok := certificates[0].PublicKey.(interface{ Equal(gocrypto.PublicKey) bool })
+	if !ok || !leafKey.Equal(publicKey) {
+		return fmt.Errorf("%w: the certificate of %s is not about key %s", ErrInvalidCertificate, certificates[0].Subject, KeyId(publicKey))
+	}
+	for i := 0; i+1 < len(certificates); i++ {
+		if err = certificates[i].CheckSignatureFrom(certificates[i+1]); err != nil {
+			return fmt.Errorf("%w: %s is not issued by %s: %s", ErrInvalidCertificate, certificates[i].Subject, certificates[i+1].Subject, err)
+		}
+	}
+	return
+}
+
+// DecodeCertificateChain reads the DER of the PEM certificates, in the same order
+func DecodeCertificateChain(encoded []byte) (chain [][]byte, err error) {
+	for {
+		var block *pem.Block
+		block, encoded = pem.Decode(encoded)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidCertificate, block.Type)
+		}
+		chain = append(chain, block.Bytes)
+	}
+	if len(chain) == 0 {
+		err = fmt.Errorf("%w: no PEM certificates found", ErrInvalidCertificate)
+	}
+	return
+}
+
+// EncodeCertificateChain returns the chain as PEM certificates, in the same order
+func EncodeCertificateChain(chain [][]byte) []byte {
+	var encoded []byte
+	for _, der := range chain {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return encoded
+}
+
+func chainName() string {
+	return keyName + ".chain"
+}
+
+// InstallCertificateChain stores the PEM chain issued for the device key next
+// to it, once checked that its leaf certifies the key
+func InstallCertificateChain(encoded []byte) (chain [][]byte, err error) {
+	if chain, err = DecodeCertificateChain(encoded); err != nil {
+		return
+	}
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	privateKey, err := cachedPrivateKey()
+	if err != nil {
+		return
+	}
+	if err = CheckCertificateChain(chain, privateKey.Public()); err != nil {
+		return
+	}
+	if err = keyStore.Store(chainName(), EncodeCertificateChain(chain)); err != nil {
+		return
+	}
+	atomic.AddInt64(&chainVersion, 1)
+	log.Printf("certificate chain of key %s installed", KeyId(privateKey.Public()))
+	return
+}
+
+// CertificateChain returns the chain installed for the device key, leaf first.
+// It fails with ErrNoCertificate if none is installed, or if it certifies a
+// key retired since.
+func CertificateChain() (chain [][]byte, err error) {
+	privateKey, err := getPrivateKey()
+	if err != nil {
+		return
+	}
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	data, err := keyStore.Load(chainName())
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrNoCertificate
+	}
+	if err != nil {
+		return
+	}
+	if chain, err = DecodeCertificateChain(data); err != nil {
+		return
+	}
+	if CheckCertificateChain(chain, privateKey.Public()) != nil {
+		return nil, fmt.Errorf("%w: the installed chain certifies a retired key", ErrNoCertificate)
+	}
+	return
+}
+
+// CertificateRequest returns the PEM-encoded PKCS #10 request of a certificate
+// with the names for the device key, to be issued by a CA
+func CertificateRequest(names CertificateNames) (encoded string, err error) {
+	privateKey, err := getPrivateKey()
+	if err != nil {
+		return
+	}
+	template, err := names.template(privateKey.Public())
+	if err != nil {
+		return
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        template.Subject,
+		DNSNames:       template.DNSNames,
+		IPAddresses:    template.IPAddresses,
+		URIs:           template.URIs,
+		EmailAddresses: template.EmailAddresses,
+	}, privateKey)
+	if err != nil {
+		return
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+func selfSignedCertificate(privateKey gocrypto.Signer, names CertificateNames) (der []byte, err error) {
+	template, err := names.template(privateKey.Public())
+	if err != nil {
+		return
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	template.SerialNumber = serialNumber
+	template.NotBefore = now.Add(-time.Hour)
+	template.NotAfter = now.Add(selfSignedValidity)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.BasicConstraintsValid = true
+	return x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+}
+
+// template fills the names of a certificate for the public key
+func (n CertificateNames) template(publicKey gocrypto.PublicKey) (template *x509.Certificate, err error) {
+	template = &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         n.CommonName,
+			SerialNumber:       n.SerialNumber,
+			Organization:       n.Organization,
+			OrganizationalUnit: n.OrganizationalUnit,
+			Locality:           n.Locality,
+			Country:            n.Country,
+		},
+		EmailAddresses: n.Emails,
+	}
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = KeyId(publicKey)
+	}
+	did, err := EncodePublicKeyToDIDKey(publicKey)
+	if err != nil {
+		return
+	}
+	for _, name := range append([]string{did}, n.URIs...) {
+		uri, err := url.Parse(name)
+		if err != nil || uri.Scheme == "" {
+			return nil, fmt.Errorf("%w: URI %q", ErrInvalidCertificateName, name)
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+	for _, host := range n.Hosts {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return
+}
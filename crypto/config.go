@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"errors"
+	"github.com/TeoSocs/alisi-client/config"
+	"log"
+)
+
+// ErrNoPassphrase means the file keystore would hold the device key in clear,
+// without being allowed to
+var ErrNoPassphrase = errors.New("no passphrase given to encrypt the keystore")
+
+// Configure opens the keystore of the settings, encrypted with the passphrase
+// of the settings, and loads the device key from it, generating it on first start.
+// The signatures are deterministic if the settings tell so.
+// The file keystore is refused without a passphrase, unless AllowUnencrypted is set.
+func Configure(keys config.Keys) (err error) {
+	store, err := OpenKeyStore(keys.Store, keys.Folder)
+	if err != nil {
+		return
+	}
+	passphrase, err := readPassphrase(keys)
+	if err != nil {
+		return
+	}
+	switch {
+	case passphrase != nil:
+		store = NewEncryptedKeyStore(store, passphrase)
+	case keys.Store == "memory":
+	case keys.AllowUnencrypted:
+		log.Println("no passphrase given, the device key is stored unencrypted")
+	default:
+		return ErrNoPassphrase
+	}
+	alg, err := ParseAlgorithm(keys.Algorithm)
+	if err != nil {
+		return
+	}
+	if err = UseKeyAlgorithm(alg); err != nil {
+		return
+	}
+	UseKeyStore(store, keys.Name)
+	UseDeterministicSignatures(keys.DeterministicSignatures)
+	return Init()
+}
+
+// EncryptKeys encrypts with the passphrase of the settings the device key, its
+// retired keys and its certificate chain stored in clear, as by a device started
+// before the passphrase was configured. It returns the IDs of the encrypted entries.
+func EncryptKeys(keys config.Keys) (keyIds []string, err error) {
+	store, err := OpenKeyStore(keys.Store, keys.Folder)
+	if err != nil {
+		return
+	}
+	passphrase, err := readPassphrase(keys)
+	if err != nil {
+		return
+	}
+	if passphrase == nil {
+		return nil, ErrNoPassphrase
+	}
+	return NewEncryptedKeyStore(store, passphrase).EncryptPlaintext(keys.Name)
+}
+
+// readPassphrase returns the keystore passphrase from the source of the settings,
+// or nil if the keystore is not encrypted
+func readPassphrase(keys config.Keys) ([]byte, error) {
+	switch {
+	case keys.PassphraseEnv != "":
+		return PassphraseFromEnv(keys.PassphraseEnv)
+	case keys.PassphraseFD >= 0:
+		return PassphraseFromFD(uintptr(keys.PassphraseFD))
+	case keys.PassphrasePrompt:
+		return PassphraseFromPrompt()
+	}
+	return nil, nil
+}
@@ -1,7 +1,9 @@
 package crypto
 
 import (
+	gocrypto "crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
@@ -10,71 +12,113 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
-	"io/ioutil"
+	"io"
 	"log"
 	"math/big"
-	"os"
 )
 
-var TEST_ENV = false
+// keyStore holds the private key of the device under the ID keyName
+var keyStore KeyStore = NewFileKeyStore("keys")
 
-var keyName = "private.pem"
+var keyName = "private"
 
-func newPrivateKey() *ecdsa.PrivateKey {
-	log.Println("creating a new private key")
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		log.Println(err)
-	}
-	log.Println("new private key created")
-	return privateKey
+// deviceKey is the device key once read from keyStore, so that it's decrypted
+// only once. It's guarded by keyMutex, and replaced by the rotations
+var deviceKey gocrypto.Signer
+
+// UseKeyStore selects the KeyStore holding the device key and the ID the key is stored under
+func UseKeyStore(store KeyStore, name string) {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	keyStore = store
+	keyName = name
+	deviceKey = nil
+	retiredKeys = nil
 }
 
-func encodePrivateKeyToPem(key *ecdsa.PrivateKey) string {
-	x509Encoded, _ := x509.MarshalECPrivateKey(key)
+func encodePrivateKeyToPem(key gocrypto.Signer) string {
+	x509Encoded, _ := x509.MarshalPKCS8PrivateKey(key)
 	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
 	log.Println("private key encoded to PEM")
 	return string(pemEncoded)
 }
 
-func decodePrivateKeyFromPem(encoded string) *ecdsa.PrivateKey {
+func decodePrivateKeyFromPem(encoded string) gocrypto.Signer {
 	block, _ := pem.Decode([]byte(encoded))
-	x509Encoded := block.Bytes
-	privateKey, err := x509.ParseECPrivateKey(x509Encoded)
+	if block == nil {
+		log.Println("invalid private key PEM")
+		return nil
+	}
+	privateKey, err := parsePrivateKey(block.Bytes)
 	if err != nil {
 		log.Print(err)
-	} else {
-		log.Println("private key decoded from PEM")
+		return nil
 	}
+	log.Println("private key decoded from PEM")
 	return privateKey
 }
 
-func EncodePublicKeyToPem(key *ecdsa.PublicKey) string {
+// parsePrivateKey reads a PKCS#8 key, or a SEC 1 ecdsa key as stored by older versions
+func parsePrivateKey(x509Encoded []byte) (privateKey gocrypto.Signer, err error) {
+	if ecKey, ecErr := x509.ParseECPrivateKey(x509Encoded); ecErr == nil {
+		return ecKey, nil
+	}
+	genericKey, err := x509.ParsePKCS8PrivateKey(x509Encoded)
+	if err != nil {
+		return
+	}
+	privateKey, ok := genericKey.(gocrypto.Signer)
+	if !ok {
+		err = fmt.Errorf("%w: %T", ErrUnsupportedKey, genericKey)
+		return
+	}
+	if _, err = AlgorithmOf(privateKey.Public()); err != nil {
+		privateKey = nil
+	}
+	return
+}
+
+func EncodePublicKeyToPem(key gocrypto.PublicKey) string {
 	x509EncodedPub, _ := x509.MarshalPKIXPublicKey(key)
 	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509EncodedPub})
 	log.Println("public key encoded to PEM")
 	return string(pemEncodedPub)
 }
 
-func DecodePublicKeyFromPem(encoded string) (publicKey *ecdsa.PublicKey, err error) {
+// DecodePublicKeyFromPem returns an *ecdsa.PublicKey or an ed25519.PublicKey
+func DecodePublicKeyFromPem(encoded string) (publicKey gocrypto.PublicKey, err error) {
 	blockPub, _ := pem.Decode([]byte(encoded))
 
 	if blockPub == nil {
 		log.Printf("Invalid publicKey: %v", encoded)
+		err = errors.New("invalid publicKey PEM")
+		return
 	}
 
 	x509EncodedPub := blockPub.Bytes
-	genericPublicKey, err := x509.ParsePKIXPublicKey(x509EncodedPub)
+	publicKey, err = x509.ParsePKIXPublicKey(x509EncodedPub)
 	if err != nil {
 		log.Printf("error parsing x509: %s", err)
 		return
 	}
-	publicKey = genericPublicKey.(*ecdsa.PublicKey)
+	if _, err = AlgorithmOf(publicKey); err != nil {
+		publicKey = nil
+		return
+	}
 	log.Println("public key decoded from PEM")
 	return
 }
 
-func Sign(message string) (r *big.Int, s *big.Int, err error) {
+// Sign signs message with the device key. The signature is DER-encoded for
+// ecdsa keys, as from EncodeSignatureDER, and the raw 64 bytes for Ed25519.
+func Sign(message string) (signature []byte, err error) {
+	signature, _, err = SignWithKid(message)
+	return
+}
+
+// SignWithKid is Sign, returning also the kid of the key that signed: unlike
+// a later CurrentKeyId, it can't name the key of a rotation made in between
+func SignWithKid(message string) (signature []byte, kid string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New(r.(string))
@@ -82,13 +126,72 @@ func Sign(message string) (r *big.Int, s *big.Int, err error) {
 		}
 	}()
 	key, err := getPrivateKey()
-	r, s = sign(message, key)
+	if err != nil {
+		return
+	}
+	kid = KeyId(key.Public())
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s := sign(message, key)
+		signature, err = EncodeSignatureDER(r, s)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(message))
+		log.Println("message signed")
+	default:
+		err = fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	}
+	return
+}
+
+// deterministic selects RFC 6979 signatures instead of randomized ones.
+// It's guarded by keyMutex, like the key it signs with
+var deterministic = false
+
+// UseDeterministicSignatures makes Sign produce RFC 6979 deterministic signatures:
+// the same message signed twice by the same key gets the same signature
+func UseDeterministicSignatures(enabled bool) {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	deterministic = enabled
+}
+
+// randomSource returns the random source of the ecdsa signatures: nil makes
+// ecdsa sign according to RFC 6979. keyMutex must not be held
+func randomSource() io.Reader {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	if deterministic {
+		return nil
+	}
+	return rand.Reader
+}
+
+// hashFor returns the hash matching the strength of the curve, as in ES256, ES384 and ES512
+func hashFor(curve elliptic.Curve) gocrypto.Hash {
+	switch curve.Params().BitSize {
+	case 384:
+		return gocrypto.SHA384
+	case 521:
+		return gocrypto.SHA512
+	}
+	return gocrypto.SHA256
+}
+
+func digest(message string, curve elliptic.Curve) (hashed []byte, hash gocrypto.Hash) {
+	hash = hashFor(curve)
+	hasher := hash.New()
+	hasher.Write([]byte(message))
+	hashed = hasher.Sum(nil)
 	return
 }
 
 func sign(message string, key *ecdsa.PrivateKey) (r *big.Int, s *big.Int) {
-	byteMessage := []byte(message)
-	r, s, err := ecdsa.Sign(rand.Reader, key, byteMessage)
+	hashed, hash := digest(message, key.Curve)
+	der, err := key.Sign(randomSource(), hashed, hash)
+	if err != nil {
+		log.Panicln(err)
+	}
+	r, s, err = DecodeSignatureDER(der)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -97,8 +200,8 @@ func sign(message string, key *ecdsa.PrivateKey) (r *big.Int, s *big.Int) {
 }
 
 func verify(key *ecdsa.PublicKey, message string, r *big.Int, s *big.Int) bool {
-	byteMessage := []byte(message)
-	check := ecdsa.Verify(key, byteMessage, r, s)
+	hashed, _ := digest(message, key.Curve)
+	check := ecdsa.Verify(key, hashed, r, s)
 	if check {
 		log.Println("signature verified")
 	} else {
@@ -107,6 +210,25 @@ func verify(key *ecdsa.PublicKey, message string, r *big.Int, s *big.Int) bool {
 	return check
 }
 
+// Verify checks the signature of message, as produced by Sign. For ecdsa keys
+// it's the DER encoding from EncodeSignatureDER, and the message is hashed with
+// the hash matching the curve of key, SHA-256 for P-256.
+func Verify(key gocrypto.PublicKey, message string, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		r, s, err := DecodeSignatureDER(signature)
+		if err != nil {
+			log.Printf("invalid DER signature: %s", err)
+			return false
+		}
+		return verify(key, message, r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, []byte(message), signature)
+	}
+	log.Printf("%s: %T", ErrUnsupportedKey, key)
+	return false
+}
+
 func EncodeSignatureDER(r *big.Int, s *big.Int) (der []byte, err error) {
 	sig := ECDSASignature{R: r, S: s}
 	der, err = asn1.Marshal(sig)
@@ -124,72 +246,83 @@ func DecodeSignatureDER(der []byte) (r *big.Int, s *big.Int, err error) {
 	return
 }
 
-func getPrivateKey() (privateKey *ecdsa.PrivateKey, err error) {
-	//var user string
-	//if TEST_ENV {
-	//	user = "test"
-	//} else {
-	//	user = "crypto"
-	//}
-	//// get signingKey
-	//secret, err := keyring.Get(service, user)
-
-	if TEST_ENV == true {
-		keyName = "test.pem"
-	}
-	keyPath := "keys/" + keyName
-	secret, err := ioutil.ReadFile(keyPath)
+// getPrivateKey returns the device key, read from the keystore on first use
+func getPrivateKey() (privateKey gocrypto.Signer, err error) {
+	keyMutex.RLock()
+	privateKey = deviceKey
+	keyMutex.RUnlock()
+	if privateKey != nil {
+		return
+	}
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	return cachedPrivateKey()
+}
+
+// cachedPrivateKey is getPrivateKey for the callers holding keyMutex for writing
+func cachedPrivateKey() (privateKey gocrypto.Signer, err error) {
+	if deviceKey == nil {
+		if deviceKey, err = loadPrivateKey(keyName); err != nil {
+			deviceKey = nil
+			return
+		}
+	}
+	return deviceKey, nil
+}
+
+func loadPrivateKey(keyId string) (privateKey gocrypto.Signer, err error) {
+	secret, err := keyStore.Load(keyId)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	log.Printf("key retrieved from %s", keyPath)
 	privateKey = decodePrivateKeyFromPem(string(secret))
+	if privateKey == nil {
+		err = fmt.Errorf("invalid key %s", keyId)
+	}
 	return
 }
 
-func GetPublicKey() (publicKey *ecdsa.PublicKey, err error) {
+// GetPublicKey returns the public key of the device, an *ecdsa.PublicKey or an ed25519.PublicKey
+func GetPublicKey() (publicKey gocrypto.PublicKey, err error) {
 	privKey, err := getPrivateKey()
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	publicKey = &privKey.PublicKey
+	publicKey = privKey.Public()
 	log.Printf("got public key")
 	return
 }
 
-func storePrivateKey(key *ecdsa.PrivateKey) {
-	if TEST_ENV == true {
-		keyName = "test.pem"
-	}
-	keyPath := "keys/" + keyName
-	if _, err := os.Stat("keys"); os.IsNotExist(err) {
-		log.Print("folder keys doesn't exists. Creating keys")
-		err = os.Mkdir("keys", os.FileMode(os.ModePerm))
-	}
+func storePrivateKey(key gocrypto.Signer) (err error) {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
 	data := []byte(encodePrivateKeyToPem(key))
-	err := ioutil.WriteFile(keyPath, data, os.FileMode(os.ModePerm))
-	//var user string
-	//if TEST_ENV {
-	//	user = "test"
-	//} else {
-	//	user = "crypto"
-	//}
-	//privatePem := encodePrivateKeyToPem(key)
-	//err := keyring.Set(service, user, privatePem)
+	err = keyStore.Store(keyName, data)
 	if err != nil {
 		log.Println(err)
+		return
 	}
-	log.Printf("key stored in %s", keyPath)
+	deviceKey = key
+	return
 }
 
 func SignJwt(claims jwt.MapClaims) (encoded string, err error) {
+	privateKey, err := getPrivateKey()
+	if err != nil {
+		return
+	}
+	method, err := signingMethodFor(privateKey.Public())
+	if err != nil {
+		return
+	}
+
 	// Create a new token object, specifying signing method and the claims
 	// you would like it to contain.
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
-
-	privateKey, err := getPrivateKey()
+	token := jwt.NewWithClaims(method, claims)
+	// lets verifiers pick the right key after a rotation
+	token.Header["kid"] = KeyId(privateKey.Public())
 
 	// Sign and get the complete encoded token as a string using the secret
 	encoded, err = token.SignedString(privateKey)
@@ -220,20 +353,32 @@ func ReadJWT(tokenString string) (claims jwt.MapClaims, err error) {
 	return
 }
 
-func CheckJWTSignature(tokenString string, key *ecdsa.PublicKey) (claims jwt.MapClaims, err error) {
+func CheckJWTSignature(tokenString string, key gocrypto.PublicKey) (claims jwt.MapClaims, err error) {
+	expected, err := signingMethodFor(key)
+	if err != nil {
+		return
+	}
+
 	// Parse takes the token string and a function for looking up the key. The latter is especially
 	// useful if you use multiple keys for your application.  The standard is to use 'kid' in the
 	// head of the token to identify which key to use, but the parsed token (head and claims) is provided
 	// to the callback, providing flexibility.
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+	// only the signature is checked here: exp and nbf are up to the caller,
+	// that can tell an expired claim from a forged one
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+		if token.Method != expected {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
 
 		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
 		return key, nil
 	})
+	if token == nil {
+		log.Print(err)
+		return
+	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 
@@ -245,14 +390,22 @@ func CheckJWTSignature(tokenString string, key *ecdsa.PublicKey) (claims jwt.Map
 	return
 }
 
-func Init() {
-	key, err := getPrivateKey()
+// Init makes sure the device key is available, generating it on first start.
+// It fails if the key exists but can't be read, e.g. because of a wrong passphrase.
+func Init() (err error) {
+	_, err = getPrivateKey()
+	if errors.Is(err, ErrKeyNotFound) {
+		log.Printf("key not found, generating a new %s one", keyAlgorithm)
+		var privateKey gocrypto.Signer
+		if privateKey, err = newPrivateKey(keyAlgorithm); err != nil {
+			return
+		}
+		err = storePrivateKey(privateKey)
+		return
+	}
 	if err != nil {
-		log.Println("key not found, generating a new one")
-		privateKey := newPrivateKey()
-		storePrivateKey(privateKey)
-	} else {
-		log.Println("key found")
-		log.Println(key.D)
+		return
 	}
+	log.Println("key found")
+	return
 }
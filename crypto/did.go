@@ -0,0 +1,223 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+)
+
+const didKeyPrefix = "did:key:"
+
+// multicodec prefixes of the supported public keys, already varint-encoded
+var multicodecPrefixes = map[Algorithm][]byte{
+	ES256: {0x80, 0x24}, // p256-pub, 0x1200
+	ES384: {0x81, 0x24}, // p384-pub, 0x1201
+	ES512: {0x82, 0x24}, // p521-pub, 0x1202
+	EdDSA: {0xed, 0x01}, // ed25519-pub, 0xed
+}
+
+// DIDDocument is the W3C DID Document of the device, as resolved from its did:key
+type DIDDocument struct {
+	Context            []string             `json:"@context"`
+	Id                 string               `json:"id"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Authentication     []string             `json:"authentication"`
+	AssertionMethod    []string             `json:"assertionMethod"`
+}
+
+type VerificationMethod struct {
+	Id                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// EncodePublicKeyToMultibase returns the base58btc multibase encoding of the
+// multicodec-prefixed key, with ecdsa points compressed
+func EncodePublicKeyToMultibase(key gocrypto.PublicKey) (encoded string, err error) {
+	alg, err := AlgorithmOf(key)
+	if err != nil {
+		return
+	}
+	var raw []byte
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		raw = elliptic.MarshalCompressed(key.Curve, key.X, key.Y)
+	case ed25519.PublicKey:
+		raw = key
+	}
+	encoded = "z" + base58Encode(append(append([]byte{}, multicodecPrefixes[alg]...), raw...))
+	return
+}
+
+func DecodePublicKeyFromMultibase(encoded string) (publicKey gocrypto.PublicKey, err error) {
+	if !strings.HasPrefix(encoded, "z") {
+		err = errors.New("only base58btc multibase keys are supported")
+		return
+	}
+	data, err := base58Decode(encoded[1:])
+	if err != nil {
+		return
+	}
+	for alg, prefix := range multicodecPrefixes {
+		if len(data) < len(prefix) || string(data[:len(prefix)]) != string(prefix) {
+			continue
+		}
+		raw := data[len(prefix):]
+		if alg == EdDSA {
+			if len(raw) != ed25519.PublicKeySize {
+				return nil, errors.New("invalid Ed25519 public key length")
+			}
+			return ed25519.PublicKey(raw), nil
+		}
+		curve, _ := curveFor(alg)
+		x, y := elliptic.UnmarshalCompressed(curve, raw)
+		if x == nil {
+			return nil, fmt.Errorf("invalid %s compressed point", curve.Params().Name)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	err = fmt.Errorf("%w: unknown multicodec", ErrUnsupportedKey)
+	return
+}
+
+// EncodePublicKeyToDIDKey returns the did:key identifier of the key
+func EncodePublicKeyToDIDKey(key gocrypto.PublicKey) (did string, err error) {
+	multibase, err := EncodePublicKeyToMultibase(key)
+	if err != nil {
+		return
+	}
+	did = didKeyPrefix + multibase
+	return
+}
+
+// DecodePublicKeyFromDIDKey resolves a did:key, or a DID URL built on it, to its public key
+func DecodePublicKeyFromDIDKey(did string) (publicKey gocrypto.PublicKey, err error) {
+	if !strings.HasPrefix(did, didKeyPrefix) {
+		err = fmt.Errorf("%s is not a did:key", did)
+		return
+	}
+	multibase := strings.SplitN(strings.TrimPrefix(did, didKeyPrefix), "#", 2)[0]
+	publicKey, err = DecodePublicKeyFromMultibase(multibase)
+	if err != nil {
+		log.Printf("error resolving %s: %s", did, err)
+		return
+	}
+	log.Println("public key decoded from did:key")
+	return
+}
+
+// DeviceDID returns the did:key identifier of the current device key
+func DeviceDID() (did string, err error) {
+	publicKey, err := GetPublicKey()
+	if err != nil {
+		return
+	}
+	return EncodePublicKeyToDIDKey(publicKey)
+}
+
+// DeviceDIDDocument builds the DID Document of the device. The current key
+// authenticates the device, the retired ones are kept as assertion methods
+// to verify what they signed.
+func DeviceDIDDocument() (document DIDDocument, err error) {
+	publicKey, err := GetPublicKey()
+	if err != nil {
+		return
+	}
+	did, err := EncodePublicKeyToDIDKey(publicKey)
+	if err != nil {
+		return
+	}
+	document = DIDDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/multikey/v1"},
+		Id:      did,
+	}
+	current, err := verificationMethodFor(did, publicKey)
+	if err != nil {
+		return
+	}
+	document.VerificationMethod = []VerificationMethod{current}
+	document.Authentication = []string{current.Id}
+	document.AssertionMethod = []string{current.Id}
+
+	retiredKeys, err := RetiredKeys()
+	if err != nil {
+		return
+	}
+	for _, retired := range retiredKeys {
+		retiredKey, err := DecodePublicKeyFromPem(retired.PublicKey)
+		if err != nil {
+			return document, err
+		}
+		method, err := verificationMethodFor(did, retiredKey)
+		if err != nil {
+			return document, err
+		}
+		document.VerificationMethod = append(document.VerificationMethod, method)
+		document.AssertionMethod = append(document.AssertionMethod, method.Id)
+	}
+	return
+}
+
+func verificationMethodFor(did string, key gocrypto.PublicKey) (method VerificationMethod, err error) {
+	multibase, err := EncodePublicKeyToMultibase(key)
+	if err != nil {
+		return
+	}
+	method = VerificationMethod{
+		Id:                 did + "#" + multibase,
+		Type:               "Multikey",
+		Controller:         did,
+		PublicKeyMultibase: multibase,
+	}
+	return
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(data []byte) string {
+	number := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var encoded []byte
+	for number.Sign() > 0 {
+		number.DivMod(number, radix, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	// every leading zero byte is encoded as the first symbol
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+func base58Decode(encoded string) (data []byte, err error) {
+	number := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range encoded {
+		digit := strings.IndexRune(base58Alphabet, r)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		number.Mul(number, radix)
+		number.Add(number, big.NewInt(int64(digit)))
+	}
+	leadingZeros := 0
+	for leadingZeros < len(encoded) && encoded[leadingZeros] == base58Alphabet[0] {
+		leadingZeros++
+	}
+	data = append(make([]byte, leadingZeros), number.Bytes()...)
+	return
+}
@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"strconv"
+	"strings"
+)
+
+var ErrDecryption = errors.New("unable to decrypt the key: wrong passphrase or corrupted data")
+
+// ErrNotEncrypted means the key is stored in clear in a keystore meant to be encrypted
+var ErrNotEncrypted = errors.New("key not encrypted")
+
+const encryptedKeyType = "ALISI ENCRYPTED PRIVATE KEY"
+
+// scrypt parameters used for newly encrypted keys. The ones used for an
+// existing key are read from its PEM headers.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// EncryptedKeyStore wraps another KeyStore, encrypting the keys at rest
+// with AES-256-GCM under a key derived from a passphrase through scrypt
+type EncryptedKeyStore struct {
+	Inner      KeyStore
+	passphrase []byte
+}
+
+func NewEncryptedKeyStore(inner KeyStore, passphrase []byte) *EncryptedKeyStore {
+	return &EncryptedKeyStore{Inner: inner, passphrase: passphrase}
+}
+
+func (e *EncryptedKeyStore) Load(keyId string) (data []byte, err error) {
+	stored, err := e.Inner.Load(keyId)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(stored)
+	if block == nil || block.Type != encryptedKeyType {
+		err = fmt.Errorf("%w: refusing to use %s", ErrNotEncrypted, keyId)
+		return
+	}
+	data, err = e.decrypt(keyId, block)
+	return
+}
+
+func (e *EncryptedKeyStore) Store(keyId string, data []byte) (err error) {
+	block, err := e.encrypt(keyId, data)
+	if err != nil {
+		return
+	}
+	err = e.Inner.Store(keyId, pem.EncodeToMemory(block))
+	return
+}
+
+func (e *EncryptedKeyStore) Delete(keyId string) error {
+	return e.Inner.Delete(keyId)
+}
+
+func (e *EncryptedKeyStore) List() ([]string, error) {
+	return e.Inner.List()
+}
+
+// EncryptPlaintext encrypts in place the entries of the inner keystore stored in
+// clear, as by a device started before a passphrase was configured. Only the
+// entries named name, or prefixed by name and a dot as the retired keys and the
+// certificate chain, are encrypted: the others may belong to another device key.
+func (e *EncryptedKeyStore) EncryptPlaintext(name string) (keyIds []string, err error) {
+	stored, err := e.Inner.List()
+	if err != nil {
+		return
+	}
+	keyIds = []string{}
+	for _, keyId := range stored {
+		if keyId != name && !strings.HasPrefix(keyId, name+".") {
+			continue
+		}
+		data, err := e.Inner.Load(keyId)
+		if err != nil {
+			return keyIds, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return keyIds, fmt.Errorf("invalid PEM in %s", keyId)
+		}
+		if block.Type == encryptedKeyType {
+			continue
+		}
+		if err = e.Store(keyId, data); err != nil {
+			return keyIds, err
+		}
+		keyIds = append(keyIds, keyId)
+	}
+	return
+}
+
+func (e *EncryptedKeyStore) encrypt(keyId string, data []byte) (block *pem.Block, err error) {
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	aead, err := e.newAEAD(salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	block = &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"Kdf":    "scrypt",
+			"N":      strconv.Itoa(scryptN),
+			"R":      strconv.Itoa(scryptR),
+			"P":      strconv.Itoa(scryptP),
+			"Salt":   hex.EncodeToString(salt),
+			"Cipher": "AES-256-GCM",
+			"Nonce":  hex.EncodeToString(nonce),
+		},
+		// the key ID is authenticated too, so an encrypted key can't be swapped with another
+		Bytes: aead.Seal(nil, nonce, data, []byte(keyId)),
+	}
+	return
+}
+
+func (e *EncryptedKeyStore) decrypt(keyId string, block *pem.Block) (data []byte, err error) {
+	if block.Headers["Kdf"] != "scrypt" || block.Headers["Cipher"] != "AES-256-GCM" {
+		err = fmt.Errorf("key %s uses an unsupported encryption scheme", keyId)
+		return
+	}
+	var params [3]int
+	for i, name := range []string{"N", "R", "P"} {
+		if params[i], err = strconv.Atoi(block.Headers[name]); err != nil {
+			err = fmt.Errorf("invalid scrypt parameter %s for key %s", name, keyId)
+			return
+		}
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return
+	}
+	aead, err := e.newAEAD(salt, params[0], params[1], params[2])
+	if err != nil {
+		return
+	}
+	if len(nonce) != aead.NonceSize() {
+		err = ErrDecryption
+		return
+	}
+	data, err = aead.Open(nil, nonce, block.Bytes, []byte(keyId))
+	if err != nil {
+		err = ErrDecryption
+	}
+	return
+}
+
+func (e *EncryptedKeyStore) newAEAD(salt []byte, n, r, p int) (aead cipher.AEAD, err error) {
+	derived, err := scrypt.Key(e.passphrase, salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return
+	}
+	blockCipher, err := aes.NewCipher(derived)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(blockCipher)
+}
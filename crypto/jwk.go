@@ -0,0 +1,205 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// JWK is the RFC 7517 JSON Web Key representation of a public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+// JWKSet is the RFC 7517 JWK Set, as served by /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKeyToJWK converts a public key to a signing JWK, with kid and alg set
+func PublicKeyToJWK(key gocrypto.PublicKey) (jwk JWK, err error) {
+	alg, err := AlgorithmOf(key)
+	if err != nil {
+		return
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk = JWK{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(padTo(key.X.Bytes(), size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padTo(key.Y.Bytes(), size)),
+		}
+	case ed25519.PublicKey:
+		jwk = JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}
+	}
+	jwk.Kid = jwk.Thumbprint()
+	jwk.Use = "sig"
+	jwk.Alg = string(alg)
+	return
+}
+
+// PublicKey returns the *ecdsa.PublicKey or ed25519.PublicKey described by the JWK
+func (j JWK) PublicKey() (publicKey gocrypto.PublicKey, err error) {
+	x, err := base64.RawURLEncoding.DecodeString(j.X)
+	if err != nil {
+		return
+	}
+	switch j.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, j.Crv)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("invalid coordinates for curve %s", j.Crv)
+		}
+		uncompressed := append(append([]byte{4}, x...), y...)
+		return ecdsa.ParseUncompressedPublicKey(curve, uncompressed)
+	case "OKP":
+		if j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, j.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	err = fmt.Errorf("%w: kty %s", ErrUnsupportedKey, j.Kty)
+	return
+}
+
+// Thumbprint computes the RFC 7638 thumbprint of the key
+func (j JWK) Thumbprint() string {
+	// required members only, in lexicographic order and without whitespaces
+	var thumbprintInput string
+	if j.Kty == "OKP" {
+		thumbprintInput = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, j.Crv, j.X)
+	} else {
+		thumbprintInput = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, j.Crv, j.Kty, j.X, j.Y)
+	}
+	hash := sha256.Sum256([]byte(thumbprintInput))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// KeyId returns the RFC 7638 thumbprint of the public key, used as "kid".
+// It's empty for unsupported keys.
+func KeyId(key gocrypto.PublicKey) string {
+	jwk, err := PublicKeyToJWK(key)
+	if err != nil {
+		return ""
+	}
+	return jwk.Kid
+}
+
+func padTo(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
+
+func EncodePublicKeyToJWK(key gocrypto.PublicKey) (encoded string, err error) {
+	jwk, err := PublicKeyToJWK(key)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(jwk)
+	if err != nil {
+		return
+	}
+	encoded = string(data)
+	log.Println("public key encoded to JWK")
+	return
+}
+
+func DecodePublicKeyFromJWK(encoded string) (publicKey gocrypto.PublicKey, err error) {
+	var jwk JWK
+	if err = json.Unmarshal([]byte(encoded), &jwk); err != nil {
+		log.Printf("error parsing JWK: %s", err)
+		return
+	}
+	publicKey, err = jwk.PublicKey()
+	if err != nil {
+		log.Printf("error parsing JWK: %s", err)
+		return
+	}
+	log.Println("public key decoded from JWK")
+	return
+}
+
+// EncodePublicKeyToDER returns the PKIX (SubjectPublicKeyInfo) DER encoding of the key
+func EncodePublicKeyToDER(key gocrypto.PublicKey) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(key)
+}
+
+// DecodePublicKey reads a public key encoded as PEM, JWK or did:key,
+// the formats accepted for the sgk and sub of a claim
+func DecodePublicKey(encoded string) (publicKey gocrypto.PublicKey, err error) {
+	trimmed := strings.TrimSpace(encoded)
+	if strings.HasPrefix(trimmed, "{") {
+		return DecodePublicKeyFromJWK(trimmed)
+	}
+	if strings.HasPrefix(trimmed, didKeyPrefix) {
+		return DecodePublicKeyFromDIDKey(trimmed)
+	}
+	return DecodePublicKeyFromPem(encoded)
+}
+
+// DeviceJWKSet lists the current device key and the retired ones
+func DeviceJWKSet() (set JWKSet, err error) {
+	publicKey, err := GetPublicKey()
+	if err != nil {
+		return
+	}
+	current, err := PublicKeyToJWK(publicKey)
+	if err != nil {
+		return
+	}
+	set.Keys = []JWK{current}
+
+	retiredKeys, err := RetiredKeys()
+	if err != nil {
+		return
+	}
+	for _, retired := range retiredKeys {
+		retiredKey, err := DecodePublicKeyFromPem(retired.PublicKey)
+		if err != nil {
+			return set, err
+		}
+		jwk, err := PublicKeyToJWK(retiredKey)
+		if err != nil {
+			return set, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return
+}
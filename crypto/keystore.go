@@ -0,0 +1,186 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/internal/atomicfile"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyStore persists the PEM-encoded private keys of the device, indexed by key ID
+type KeyStore interface {
+	Load(keyId string) ([]byte, error)
+	Store(keyId string, data []byte) error
+	Delete(keyId string) error
+	List() ([]string, error)
+}
+
+// OpenKeyStore returns the KeyStore implementation named by backend.
+// location is the folder used by the file backend and it's ignored by the others.
+func OpenKeyStore(backend string, location string) (KeyStore, error) {
+	switch backend {
+	case "file":
+		return NewFileKeyStore(location), nil
+	case "memory":
+		return NewMemoryKeyStore(), nil
+	}
+	return nil, fmt.Errorf("unknown keystore backend %q", backend)
+}
+
+func checkKeyId(keyId string) error {
+	check, err := path.Match("*", keyId)
+	if err != nil {
+		return err
+	}
+	if !check || keyId == "" {
+		return fmt.Errorf("invalid key ID %q. Use a literal name without '/' characters instead", keyId)
+	}
+	return nil
+}
+
+// FileKeyStore keeps every key in a PEM file named after its ID
+type FileKeyStore struct {
+	Folder string
+}
+
+func NewFileKeyStore(folder string) *FileKeyStore {
+	return &FileKeyStore{Folder: folder}
+}
+
+func (f *FileKeyStore) pathFor(keyId string) (keyPath string, err error) {
+	if err = checkKeyId(keyId); err != nil {
+		return
+	}
+	keyPath = path.Join(f.Folder, keyId+".pem")
+	return
+}
+
+func (f *FileKeyStore) Load(keyId string) (data []byte, err error) {
+	keyPath, err := f.pathFor(keyId)
+	if err != nil {
+		return
+	}
+	data, err = ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("%w: %s", ErrKeyNotFound, keyPath)
+		return
+	}
+	if err != nil {
+		return
+	}
+	log.Printf("key retrieved from %s", keyPath)
+	return
+}
+
+func (f *FileKeyStore) Store(keyId string, data []byte) (err error) {
+	keyPath, err := f.pathFor(keyId)
+	if err != nil {
+		return
+	}
+	if _, err = os.Stat(f.Folder); os.IsNotExist(err) {
+		log.Printf("folder %s doesn't exists. Creating %s", f.Folder, f.Folder)
+		err = os.Mkdir(f.Folder, 0700)
+	}
+	if err != nil {
+		return
+	}
+	// a crash while replacing the key, as in a rotation, must leave the old key or the new one
+	if err = atomicfile.WriteFile(keyPath, data); err != nil {
+		return
+	}
+	log.Printf("key stored in %s", keyPath)
+	return
+}
+
+func (f *FileKeyStore) Delete(keyId string) (err error) {
+	keyPath, err := f.pathFor(keyId)
+	if err != nil {
+		return
+	}
+	err = os.Remove(keyPath)
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("%w: %s", ErrKeyNotFound, keyPath)
+	}
+	return
+}
+
+func (f *FileKeyStore) List() (keyIds []string, err error) {
+	keyIds = []string{}
+	fileInfoList, err := ioutil.ReadDir(f.Folder)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	for _, fInfo := range fileInfoList {
+		if fInfo.IsDir() || !strings.HasSuffix(fInfo.Name(), ".pem") {
+			continue
+		}
+		keyIds = append(keyIds, strings.TrimSuffix(fInfo.Name(), ".pem"))
+	}
+	return
+}
+
+// MemoryKeyStore keeps the keys in memory only. Meant for tests
+type MemoryKeyStore struct {
+	mutex sync.Mutex
+	keys  map[string][]byte
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: map[string][]byte{}}
+}
+
+func (m *MemoryKeyStore) Load(keyId string) (data []byte, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stored, ok := m.keys[keyId]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrKeyNotFound, keyId)
+		return
+	}
+	data = append([]byte(nil), stored...)
+	return
+}
+
+func (m *MemoryKeyStore) Store(keyId string, data []byte) (err error) {
+	if err = checkKeyId(keyId); err != nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys[keyId] = append([]byte(nil), data...)
+	return
+}
+
+func (m *MemoryKeyStore) Delete(keyId string) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.keys[keyId]; !ok {
+		err = fmt.Errorf("%w: %s", ErrKeyNotFound, keyId)
+		return
+	}
+	delete(m.keys, keyId)
+	return
+}
+
+func (m *MemoryKeyStore) List() (keyIds []string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keyIds = []string{}
+	for keyId := range m.keys {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+	return
+}
@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"io/ioutil"
+	"os"
+)
+
+// PassphraseFromEnv reads the keystore passphrase from the environment variable name
+func PassphraseFromEnv(name string) (passphrase []byte, err error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		err = fmt.Errorf("environment variable %s is not set", name)
+		return
+	}
+	passphrase = []byte(value)
+	return
+}
+
+// PassphraseFromFD reads the keystore passphrase from an already open file descriptor,
+// e.g. a pipe set up by the service manager. A trailing newline is dropped.
+func PassphraseFromFD(fd uintptr) (passphrase []byte, err error) {
+	file := os.NewFile(fd, "passphrase")
+	if file == nil {
+		err = fmt.Errorf("invalid file descriptor %d", fd)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return
+	}
+	passphrase = bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		err = errors.New("empty passphrase")
+	}
+	return
+}
+
+// PassphraseFromPrompt asks the passphrase on the terminal attached to stdin
+func PassphraseFromPrompt() (passphrase []byte, err error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		err = errors.New("stdin is not a terminal, can't prompt for the passphrase")
+		return
+	}
+	fmt.Fprint(os.Stderr, "keystore passphrase: ")
+	passphrase, err = term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err == nil && len(passphrase) == 0 {
+		err = errors.New("empty passphrase")
+	}
+	return
+}
@@ -0,0 +1,218 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyMutex prevents reading the device key while it's being rotated
+var keyMutex sync.RWMutex
+
+// retiredKeys caches the list of RetiredKeys, the most recent first, so that
+// the retired keys are decrypted only once. It's guarded by keyMutex, nil until loaded
+var retiredKeys []RetiredKey
+
+// RetiredKey is a device key replaced by a rotation, kept to verify
+// what has been signed before
+type RetiredKey struct {
+	KeyId string `json:"kid"`
+
+	// PEM-encoded public key
+	PublicKey string `json:"publicKey"`
+
+	// Unix time of the rotation
+	RetiredAt int64 `json:"retiredAt"`
+
+	// kid of the key that replaced this one
+	Successor string `json:"successor"`
+
+	// JWT signed by this key, stating its successor
+	Handover string `json:"handover"`
+}
+
+// CurrentKeyId returns the kid of the device key in use
+func CurrentKeyId() (kid string, err error) {
+	publicKey, err := GetPublicKey()
+	if err != nil {
+		return
+	}
+	kid = KeyId(publicKey)
+	return
+}
+
+func retiredKeyName(kid string) string {
+	return keyName + ".retired." + kid
+}
+
+// RotateKey replaces the device key with a new one. The old key is kept
+// as retired, together with a handover JWT signed by the old key that
+// states the new public key.
+func RotateKey() (retired RetiredKey, err error) {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+
+	oldKey, err := cachedPrivateKey()
+	if err != nil {
+		return
+	}
+	newKey, err := newPrivateKey(keyAlgorithm)
+	if err != nil {
+		return
+	}
+	oldKid := KeyId(oldKey.Public())
+	newKid := KeyId(newKey.Public())
+	method, err := signingMethodFor(oldKey.Public())
+	if err != nil {
+		return
+	}
+
+	retired = RetiredKey{
+		KeyId:     oldKid,
+		PublicKey: EncodePublicKeyToPem(oldKey.Public()),
+		RetiredAt: time.Now().Unix(),
+		Successor: newKid,
+	}
+	handover := jwt.NewWithClaims(method, jwt.MapClaims{
+		"iat":     retired.RetiredAt,
+		"old_kid": oldKid,
+		"new_kid": newKid,
+		"new_key": EncodePublicKeyToPem(newKey.Public()),
+	})
+	handover.Header["kid"] = oldKid
+	handover.Header["typ"] = "key-handover+jwt"
+	retired.Handover, err = handover.SignedString(oldKey)
+	if err != nil {
+		return
+	}
+
+	// the old key is saved as retired before being replaced, so it can't get lost
+	block, _ := pem.Decode([]byte(encodePrivateKeyToPem(oldKey)))
+	block.Headers = map[string]string{
+		"Retired-At": strconv.FormatInt(retired.RetiredAt, 10),
+		"Successor":  newKid,
+		"Handover":   retired.Handover,
+	}
+	if err = keyStore.Store(retiredKeyName(oldKid), pem.EncodeToMemory(block)); err != nil {
+		return
+	}
+	if err = keyStore.Store(keyName, []byte(encodePrivateKeyToPem(newKey))); err != nil {
+		// the old key is still the device key, it mustn't be listed as retired
+		if deleteErr := keyStore.Delete(retiredKeyName(oldKid)); deleteErr != nil {
+			log.Printf("error removing retired key %s: %s", oldKid, deleteErr)
+		}
+		return
+	}
+	deviceKey = newKey
+	if retiredKeys != nil {
+		retiredKeys = append([]RetiredKey{retired}, retiredKeys...)
+	}
+	log.Printf("key %s rotated, %s is the new device key", oldKid, newKid)
+	return
+}
+
+// RetiredKeys lists the keys replaced by a rotation, the most recent first
+func RetiredKeys() (keys []RetiredKey, err error) {
+	keyMutex.RLock()
+	keys = retiredKeys
+	keyMutex.RUnlock()
+	if keys == nil {
+		keyMutex.Lock()
+		defer keyMutex.Unlock()
+		if retiredKeys == nil {
+			if retiredKeys, err = loadRetiredKeys(); err != nil {
+				return
+			}
+		}
+		keys = retiredKeys
+	}
+	// the callers can't change the cache
+	return append([]RetiredKey{}, keys...), nil
+}
+
+// loadRetiredKeys reads the retired keys from the keystore. keyMutex must be held
+func loadRetiredKeys() (keys []RetiredKey, err error) {
+	keyIds, err := keyStore.List()
+	if err != nil {
+		return
+	}
+	keys = []RetiredKey{}
+	prefix := retiredKeyName("")
+	for _, keyId := range keyIds {
+		if !strings.HasPrefix(keyId, prefix) {
+			continue
+		}
+		data, err := keyStore.Load(keyId)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid retired key %s", keyId)
+		}
+		privateKey, err := parsePrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		retiredAt, _ := strconv.ParseInt(block.Headers["Retired-At"], 10, 64)
+		keys = append(keys, RetiredKey{
+			KeyId:     strings.TrimPrefix(keyId, prefix),
+			PublicKey: EncodePublicKeyToPem(privateKey.Public()),
+			RetiredAt: retiredAt,
+			Successor: block.Headers["Successor"],
+			Handover:  block.Headers["Handover"],
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].RetiredAt > keys[j].RetiredAt
+	})
+	return
+}
+
+// CheckHandover verifies a handover statement against the public key it was
+// signed with, returning the PEM-encoded public key it hands over to
+func CheckHandover(handover string, oldKey gocrypto.PublicKey) (newKey string, err error) {
+	claims, err := CheckJWTSignature(handover, oldKey)
+	if err != nil {
+		return
+	}
+	newKey, ok := claims["new_key"].(string)
+	if !ok {
+		err = errors.New("handover without new_key")
+	}
+	return
+}
+
+// IsDeviceKey tells whether the public key is the current device key or one
+// of the retired ones, so that claims issued before a rotation stay valid
+func IsDeviceKey(publicKey gocrypto.PublicKey) (ok bool, err error) {
+	kid := KeyId(publicKey)
+	if kid == "" {
+		return
+	}
+	current, err := CurrentKeyId()
+	if err != nil {
+		return
+	}
+	if kid == current {
+		return true, nil
+	}
+	keys, err := RetiredKeys()
+	if err != nil {
+		return
+	}
+	for _, retired := range keys {
+		if retired.KeyId == kid {
+			return true, nil
+		}
+	}
+	return
+}
@@ -0,0 +1,227 @@
+package datamodel
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNonceInvalid  = errors.New("invalid nonce")
+	ErrNonceExpired  = errors.New("nonce expired")
+	ErrNonceReplayed = errors.New("nonce already used")
+
+	// ErrTooManyChallenges means the registry holds its limit of unexpired challenges,
+	// or of remembered nonces chosen by the verifiers
+	ErrTooManyChallenges = errors.New("too many outstanding challenges")
+)
+
+// minimum length of a nonce chosen by the verifier, to make it unpredictable
+const minVerifierNonceLength = 16
+
+// Challenge is a nonce issued by the device, to be used in a single presentation
+type Challenge struct {
+	Nonce string `json:"nonce"`
+
+	// Unix time after which the nonce is refused
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// PresentationRequest asks the device to present a claim to a verifier
+type PresentationRequest struct {
+	// Nonce issued by /challenge, or chosen by the verifier
+	Nonce string `json:"nonce"`
+
+	// Identifier of the control unit asking for the claim
+	Verifier string `json:"verifier"`
+}
+
+// Attestation is the payload signed by the device when presenting a claim
+type Attestation struct {
+	Nonce string `json:"nonce"`
+
+	ClaimId string `json:"claimId"`
+
+	// base64url SHA-256 of the EncodedData of the claim
+	DataHash string `json:"dataHash"`
+
+	// Unix time of the signature, according to the device
+	Timestamp int64 `json:"timestamp"`
+
+	// Identifier of the control unit the claim is presented to
+	Verifier string `json:"verifier"`
+}
+
+// SignedClaim is a claim presented to a verifier, together with the attestation
+// that binds it to the verifier nonce
+type SignedClaim struct {
+	Id string `json:"id"`
+
+	// JWT-encoded claim
+	EncodedData string `json:"encodedData"`
+
+	// base64url encoding of the JSON Attestation, exactly as signed
+	Payload string `json:"payload"`
+
+	// base64 signature of the payload, made by the device key
+	Signature string `json:"signature"`
+
+	// kid of the device key that signed the payload
+	Kid string `json:"kid"`
+}
+
+// ChallengeRegistry tracks the nonces issued by the device and the ones
+// already signed, refusing to sign the same nonce twice
+type ChallengeRegistry struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	limit   int
+	issued  map[string]time.Time
+	expired map[string]time.Time
+	used    map[string]time.Time
+}
+
+// NewChallengeRegistry creates a registry whose nonces are valid for ttl, and
+// that holds at most limit of them at once, 0 for no limit.
+// Verifier-supplied nonces are remembered for ttl too, and count against the limit.
+func NewChallengeRegistry(ttl time.Duration, limit int) *ChallengeRegistry {
+	return &ChallengeRegistry{
+		ttl:     ttl,
+		limit:   limit,
+		issued:  map[string]time.Time{},
+		expired: map[string]time.Time{},
+		used:    map[string]time.Time{},
+	}
+}
+
+// Issue creates a new random nonce. It fails with ErrTooManyChallenges while
+// the limit of unexpired nonces is reached, as anyone can ask for them
+func (c *ChallengeRegistry) Issue() (challenge Challenge, err error) {
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	expiresAt := time.Now().Add(c.ttl)
+	challenge = Challenge{
+		Nonce:     base64.RawURLEncoding.EncodeToString(random),
+		ExpiresAt: expiresAt.Unix(),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purge()
+	if c.limit > 0 && len(c.issued) >= c.limit {
+		return Challenge{}, ErrTooManyChallenges
+	}
+	c.issued[challenge.Nonce] = expiresAt
+	return
+}
+
+// Consume marks the nonce as used. It accepts nonces issued by the registry
+// before they expire and fresh nonces chosen by the verifier. These fail with
+// ErrTooManyChallenges while the limit of remembered nonces is reached.
+func (c *ChallengeRegistry) Consume(nonce string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purge()
+
+	now := time.Now()
+	if expiresAt, ok := c.issued[nonce]; ok {
+		delete(c.issued, nonce)
+		c.used[nonce] = expiresAt
+		return nil
+	}
+	if _, ok := c.expired[nonce]; ok {
+		return ErrNonceExpired
+	}
+	if _, ok := c.used[nonce]; ok {
+		return ErrNonceReplayed
+	}
+	if len(nonce) < minVerifierNonceLength {
+		return fmt.Errorf("%w: a nonce chosen by the verifier needs at least %d characters", ErrNonceInvalid, minVerifierNonceLength)
+	}
+	if c.limit > 0 && len(c.used) >= c.limit {
+		return ErrTooManyChallenges
+	}
+	c.used[nonce] = now.Add(c.ttl)
+	return nil
+}
+
+// purge forgets the expired nonces. An issued nonce is remembered as expired
+// for another ttl, so it can't be passed off as chosen by the verifier.
+// Must be called holding the mutex
+func (c *ChallengeRegistry) purge() {
+	now := time.Now()
+	for nonce, expiresAt := range c.issued {
+		if now.After(expiresAt) {
+			delete(c.issued, nonce)
+			c.expired[nonce] = expiresAt.Add(c.ttl)
+		}
+	}
+	for _, nonces := range []map[string]time.Time{c.expired, c.used} {
+		for nonce, forgetAt := range nonces {
+			if now.After(forgetAt) {
+				delete(nonces, nonce)
+			}
+		}
+	}
+}
+
+// Attest signs the presentation of the claim to verifier, bound to nonce
+func (c EncodedClaim) Attest(nonce string, verifier string) (signed SignedClaim, err error) {
+	attestation := Attestation{
+		Nonce:     nonce,
+		ClaimId:   c.Id,
+		DataHash:  hashEncodedData(c.EncodedData),
+		Timestamp: time.Now().Unix(),
+		Verifier:  verifier,
+	}
+	payload, err := json.Marshal(attestation)
+	if err != nil {
+		return
+	}
+	// the kid must name the key that signed, even during a rotation
+	signature, kid, err := crypto.SignWithKid(string(payload))
+	if err != nil {
+		return
+	}
+	signed = SignedClaim{
+		Id:          c.Id,
+		EncodedData: c.EncodedData,
+		Payload:     base64.RawURLEncoding.EncodeToString(payload),
+		Signature:   base64.StdEncoding.EncodeToString(signature),
+		Kid:         kid,
+	}
+	log.Infof("claim %s attested for %s", c.Id, verifier)
+	return
+}
+
+// Verify checks the signature of the presentation against the device public key,
+// and that the attestation refers to the presented claim
+func (s SignedClaim) Verify(publicKey gocrypto.PublicKey) (attestation Attestation, err error) {
+	payload, err := base64.RawURLEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return
+	}
+	if !crypto.Verify(publicKey, string(payload), signature) {
+		err = errors.New("invalid attestation signature")
+		return
+	}
+	if err = json.Unmarshal(payload, &attestation); err != nil {
+		return
+	}
+	if attestation.ClaimId != s.Id || attestation.DataHash != hashEncodedData(s.EncodedData) {
+		err = errors.New("the attestation refers to another claim")
+	}
+	return
+}
@@ -0,0 +1,293 @@
+package datamodel
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var claimBucket = []byte("claims")
+
+// historyBucket holds the versions of each claim, as a JSON array
+var historyBucket = []byte("history")
+
+// BoltStore keeps the claims in a bbolt database, for devices holding
+// too many claims to keep a file for each one
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the database in the file, creating it if needed
+func OpenBoltStore(file string) (store *BoltStore, err error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(claimBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return
+	}
+	store = &BoltStore{db: db}
+	return
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Create(c EncodedClaim) error {
+	return s.put(c, false)
+}
+
+func (s *BoltStore) Overwrite(c EncodedClaim) error {
+	return s.put(c, true)
+}
+
+// put stores the claim, that must already exist if overwrite is set,
+// and must not otherwise
+func (s *BoltStore) put(c EncodedClaim, overwrite bool) error {
+	if err := checkClaimId(c.Id); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(claimBucket)
+		exists := bucket.Get([]byte(c.Id)) != nil
+		if exists && !overwrite {
+			return claimExists(c.Id)
+		}
+		if !exists && overwrite {
+			return claimNotFound(c.Id)
+		}
+		if err := bucket.Put([]byte(c.Id), data); err != nil {
+			return err
+		}
+		operation := OperationCreate
+		if overwrite {
+			operation = OperationOverwrite
+		}
+		return record(tx, c.Id, operation, &c)
+	})
+}
+
+func (s *BoltStore) Update(claimId string, update func(current EncodedClaim) (EncodedClaim, error)) error {
+	if err := checkClaimId(claimId); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(claimBucket)
+		data := bucket.Get([]byte(claimId))
+		if data == nil {
+			return claimNotFound(claimId)
+		}
+		var current EncodedClaim
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+		updated, err := update(current)
+		if err != nil {
+			return err
+		}
+		if err = checkSameId(claimId, updated); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(updated); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte(claimId), data); err != nil {
+			return err
+		}
+		return record(tx, claimId, OperationOverwrite, &updated)
+	})
+}
+
+func (s *BoltStore) Get(claimId string) (claim EncodedClaim, err error) {
+	if err = checkClaimId(claimId); err != nil {
+		return
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(claimBucket).Get([]byte(claimId))
+		if data == nil {
+			return claimNotFound(claimId)
+		}
+		return json.Unmarshal(data, &claim)
+	})
+	return
+}
+
+func (s *BoltStore) List() (claimList []string, err error) {
+	claimList = []string{}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		// keys are iterated in byte order
+		return tx.Bucket(claimBucket).ForEach(func(key, _ []byte) error {
+			claimList = append(claimList, string(key))
+			return nil
+		})
+	})
+	return
+}
+
+func (s *BoltStore) Delete(claimId string) error {
+	if err := checkClaimId(claimId); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(claimBucket)
+		if bucket.Get([]byte(claimId)) == nil {
+			return claimNotFound(claimId)
+		}
+		if err := bucket.Delete([]byte(claimId)); err != nil {
+			return err
+		}
+		return record(tx, claimId, OperationDelete, nil)
+	})
+}
+
+// ExpireAll looks for the expired claims in a read transaction, and removes
+// them in a single write one: nothing is written while no claim expires
+func (s *BoltStore) ExpireAll(expired func(current EncodedClaim) bool) (removedIds []string, err error) {
+	var candidates []string
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(claimBucket).ForEach(func(key, data []byte) error {
+			var current EncodedClaim
+			if err := json.Unmarshal(data, &current); err != nil {
+				return err
+			}
+			if expired(current) {
+				candidates = append(candidates, string(key))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(candidates) == 0 {
+		return
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		removedIds = nil
+		bucket := tx.Bucket(claimBucket)
+		for _, claimId := range candidates {
+			// the claim may be replaced or deleted in the meantime
+			data := bucket.Get([]byte(claimId))
+			if data == nil {
+				continue
+			}
+			var current EncodedClaim
+			if err := json.Unmarshal(data, &current); err != nil {
+				return err
+			}
+			if !expired(current) {
+				continue
+			}
+			if err := bucket.Delete([]byte(claimId)); err != nil {
+				return err
+			}
+			if err := record(tx, claimId, OperationExpire, nil); err != nil {
+				return err
+			}
+			removedIds = append(removedIds, claimId)
+		}
+		return nil
+	})
+	if err != nil {
+		removedIds = nil
+	}
+	return
+}
+
+func (s *BoltStore) History(claimId string) (history []ClaimVersion, err error) {
+	if err = checkClaimId(claimId); err != nil {
+		return
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if history, err = readHistory(tx, claimId); err != nil || len(history) > 0 {
+			return err
+		}
+		if tx.Bucket(claimBucket).Get([]byte(claimId)) == nil {
+			return claimNotFound(claimId)
+		}
+		history = []ClaimVersion{}
+		return nil
+	})
+	return
+}
+
+// Purge looks for the histories to trim in a read transaction, and trims them
+// in a single write one: nothing is written while the policy retains everything
+func (s *BoltStore) Purge(policy RetentionPolicy) error {
+	now := time.Now()
+	var trimmed []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEach(func(key, _ []byte) error {
+			history, err := readHistory(tx, string(key))
+			if err != nil {
+				return err
+			}
+			if len(policy.retain(history, now)) < len(history) {
+				trimmed = append(trimmed, string(key))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(trimmed) == 0 {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		for _, claimId := range trimmed {
+			// the history may grow in the meantime
+			history, err := readHistory(tx, claimId)
+			if err != nil {
+				return err
+			}
+			kept := policy.retain(history, now)
+			if len(kept) == len(history) {
+				continue
+			}
+			if len(kept) == 0 {
+				err = bucket.Delete([]byte(claimId))
+			} else {
+				err = putHistory(tx, claimId, kept)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readHistory(tx *bolt.Tx, claimId string) (history []ClaimVersion, err error) {
+	data := tx.Bucket(historyBucket).Get([]byte(claimId))
+	if data == nil {
+		return
+	}
+	err = json.Unmarshal(data, &history)
+	return
+}
+
+func putHistory(tx *bolt.Tx, claimId string, history []ClaimVersion) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(historyBucket).Put([]byte(claimId), data)
+}
+
+// record adds the operation to the history of the claim, in the same transaction
+func record(tx *bolt.Tx, claimId string, operation string, claim *EncodedClaim) error {
+	history, err := readHistory(tx, claimId)
+	if err != nil {
+		return err
+	}
+	return putHistory(tx, claimId, appendVersion(history, operation, claim))
+}
@@ -15,15 +15,27 @@ type Claim struct {
 	// Iroha ID of the issuer
 	Iss string `json:"iss,omitempty"`
 
-	// PublicKey to use for signature verification
+	// PublicKey to use for signature verification, PEM or JWK
 	Sgk string `json:"sgk,omitempty"`
 
-	// DID of the subject of the DID
+	// DID of the subject of the DID: did:key, PEM or JWK public key
 	Sub string `json:"sub,omitempty"`
 
 	// Issued AT, unix time
-	Iat int32 `json:"iat,omitempty"`
+	Iat int64 `json:"iat,omitempty"`
+
+	// Not BeFore: the claim can't be presented before this unix time. Optional
+	Nbf int64 `json:"nbf,omitempty"`
+
+	// EXPiration: the claim can't be presented from this unix time on. Optional
+	Exp int64 `json:"exp,omitempty"`
+
+	// JWT ID, that revocation lists can name the claim with. Optional
+	Jti string `json:"jti,omitempty"`
 
 	// JSON content of the claim
 	Claim string `json:"claim,omitempty"`
+
+	// Status of the stored claim, filled in by the device: valid or revoked
+	Status string `json:"status,omitempty"`
 }
@@ -0,0 +1,39 @@
+package datamodel
+
+import (
+	"github.com/TeoSocs/alisi-client/config"
+	"time"
+)
+
+// Configure loads the trusted issuers and the revocation lists of the settings
+func Configure(claims config.Claims) (err error) {
+	issuers, err := OpenIssuerRegistry(claims.Issuers)
+	if err != nil {
+		return
+	}
+	revocations, err := OpenRevocationRegistry(claims.Revocations)
+	if err != nil {
+		return
+	}
+	UseIssuerRegistry(issuers)
+	UseRevocationRegistry(revocations)
+	return
+}
+
+// OpenConfiguredStore opens the claim store of the settings
+func OpenConfiguredStore(claims config.Claims) (ClaimStore, error) {
+	return OpenClaimStore(claims.Store, claims.Location)
+}
+
+// NewJanitor returns a janitor of the store, sweeping it with the retention
+// and the interval of the settings
+func NewJanitor(store ClaimStore, claims config.Claims) *Janitor {
+	return &Janitor{
+		Store: store,
+		Retention: RetentionPolicy{
+			Versions: claims.HistoryVersions,
+			MaxAge:   time.Duration(claims.HistoryDays) * 24 * time.Hour,
+		},
+		Interval: claims.JanitorInterval,
+	}
+}
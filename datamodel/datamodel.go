@@ -1,182 +1,138 @@
 package datamodel
 
 import (
+	gocrypto "crypto"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/TeoSocs/alisi-client/crypto"
-	"github.com/dgrijalva/jwt-go"
+	"github.com/TeoSocs/alisi-client/internal/atomicfile"
 	"github.com/op/go-logging"
-	"io/ioutil"
 	"os"
 	"path"
+	"time"
 )
 
 var log = logging.MustGetLogger("alisi")
 
+// CLAIM_FOLDER is the default folder of the directory store
 const CLAIM_FOLDER = "claims"
 
-func (c EncodedClaim) CreateAndStore() (err error) {
-
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(r.(string))
-		}
-	}()
-	claimId := c.Id
-	claimPath := getPathFor(claimId)
-	checkNonExistent(claimPath)
-	c.writeInFile(claimPath)
+// CreateAndStore validates the claim and adds it to the store
+func (c EncodedClaim) CreateAndStore(store ClaimStore) (err error) {
+	if err = checkClaimId(c.Id); err != nil {
+		return
+	}
+	if _, err = c.Validate(); err != nil {
+		log.Errorf("claim %s refused: %s", c.Id, err)
+		return
+	}
+	// the JWT is stored exactly as issued, signature is only set on presentation
+	c.Signature = ""
+	if err = store.Create(c); err != nil {
+		return
+	}
 
-	log.Infof("claim %s stored", path.Base(claimPath))
+	log.Infof("claim %s stored", c.Id)
 	return
 }
 
-func GetClaim(claimId string) (claim Claim, err error) {
-
-	// WARNING: checkExistent can Panic
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
-			return
-		}
-	}()
-
-	claimPath := getPathFor(claimId)
-	log.Debugf("retrieving claim from %s", claimPath)
-	checkExistent(claimPath)
-	data, err := ioutil.ReadFile(claimPath)
+// GetClaim reads the claim from the store, checking its signature and that it
+// can be presented now, and fills its Status. It returns the ETag of the claim too.
+func GetClaim(store ClaimStore, claimId string) (claim Claim, etag string, err error) {
+	enClaim, err := GetEncoded(store, claimId)
 	if err != nil {
-		log.Error("error reading file %s: %s", path.Base(claimPath), err)
 		return
 	}
-	enClaim := EncodedClaim{}
-	err = json.Unmarshal(data, &enClaim)
+	claim, err = enClaim.Decode()
 	if err != nil {
-		log.Error("error reading encodedClaim: %s", err)
+		log.Errorf("error validating JWT: %s", err)
 		return
 	}
-
-	clearData, err := crypto.ReadJWT(enClaim.EncodedData)
-	publicKey, err := crypto.DecodePublicKeyFromPem(clearData["sgk"].(string))
-	if err != nil {
-		log.Error("error reading publicKey: %s", err)
+	if err = claim.ValidAt(time.Now()); err != nil {
 		return
 	}
-	mapClaims, err := crypto.CheckJWTSignature(enClaim.EncodedData, publicKey)
-	if err != nil {
-		log.Error("error validating JWT: %s", err)
+	if claim.Status, err = ClaimStatus(enClaim); err != nil {
 		return
 	}
-	//parsedTime, err := time.Parse(time.RFC3339, mapClaims["iat"].(string))
-	//parsedTime := time.Unix(mapClaims["iat"].(int64), 0)
-
-	//parsedTime, err := strconv.Atoi(mapClaims["iat"].(float64))
-	//if err != nil {
-	//	log.Error("error parsing timestamp: %s", err)
-	//	return
-	//}
-
-	claim = Claim{
-		Iss:   mapClaims["iss"].(string),
-		Iat:   int32(mapClaims["iat"].(float64)),
-		Sgk:   mapClaims["sgk"].(string),
-		Sub:   mapClaims["sub"].(string),
-		Claim: mapClaims["claim"].(string),
-	}
-	log.Infof("claim %s retrieved", path.Base(claimPath))
-	return
+	log.Infof("claim %s retrieved", claimId)
+	return claim, enClaim.ETag(), nil
 }
 
-func GetEncoded(claimId string) (claim EncodedClaim, err error) {
-
-	// WARNING: checkExistent can Panic
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(r.(string))
-			return
-		}
-	}()
-
-	claimPath := getPathFor(claimId)
-	log.Debugf("retrieving claim from %s", claimPath)
-	checkExistent(claimPath)
-	data, err := ioutil.ReadFile(claimPath)
-	if err != nil {
-		log.Error("error reading file %s: %s", path.Base(claimPath), err)
+// Replace validates the claim and stores it in place of the one with the same ID.
+// The stored claim must still have the given ETag, or etag must be "*", and be
+// issued before the new one. It returns the ETag of the new claim.
+func (c EncodedClaim) Replace(store ClaimStore, etag string) (newETag string, err error) {
+	if err = checkClaimId(c.Id); err != nil {
 		return
 	}
-	err = json.Unmarshal(data, &claim)
+	claim, err := c.Validate()
 	if err != nil {
-		log.Error("error decoding JWT: %s", err)
+		log.Errorf("claim %s refused: %s", c.Id, err)
 		return
 	}
-
-	log.Infof("encodedClaim %s retrieved", path.Base(claimPath))
-	return
-}
-
-func GetClaimList() (claimList []string, err error) {
-	if _, err = os.Stat(CLAIM_FOLDER); os.IsNotExist(err) {
-		log.Debugf("folder %s doesn't exists. Creating %s", CLAIM_FOLDER, CLAIM_FOLDER)
-		err = os.Mkdir(CLAIM_FOLDER, os.FileMode(os.ModePerm))
-	}
-
+	c.Signature = ""
+	err = store.Update(c.Id, func(current EncodedClaim) (EncodedClaim, error) {
+		if etag != "*" && etag != current.ETag() {
+			return current, &ClaimError{ClaimId: c.Id, Err: ErrETagMismatch}
+		}
+		stored, err := current.times()
+		if err != nil {
+			return current, err
+		}
+		if claim.Iat <= stored.Iat {
+			return current, fmt.Errorf("%w: iat %d, stored claim issued at %d", ErrStaleClaim, claim.Iat, stored.Iat)
+		}
+		return c, nil
+	})
 	if err != nil {
-		log.Error(err)
 		return
 	}
 
-	fileInfoList, err := ioutil.ReadDir(CLAIM_FOLDER)
+	log.Infof("claim %s replaced", c.Id)
+	return c.ETag(), nil
+}
+
+func GetEncoded(store ClaimStore, claimId string) (claim EncodedClaim, err error) {
+	claim, err = store.Get(claimId)
 	if err != nil {
+		err = tombstoneOr(store, claimId, err)
 		return
 	}
-	claimList = []string{}
-	for _, fInfo := range fileInfoList {
-		claimList = append(claimList, fInfo.Name())
-	}
 
+	log.Infof("encodedClaim %s retrieved", claimId)
 	return
 }
 
-func (c EncodedClaim) Overwrite() (err error) {
+func GetClaimList(store ClaimStore) (claimList []string, err error) {
+	return store.List()
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(r.(string))
-			return
-		}
-	}()
-	claimId := c.Id
-	claimPath := getPathFor(claimId)
-	checkExistent(claimPath)
-	c.writeInFile(claimPath)
+func (c EncodedClaim) Overwrite(store ClaimStore) (err error) {
+	if err = store.Overwrite(c); err != nil {
+		return
+	}
 
-	log.Infof("claim %s stored", path.Base(claimPath))
+	log.Infof("claim %s stored", c.Id)
 	return
 }
 
-func DeleteClaim(claimId string) (err error) {
-
-	claimPath := getPathFor(claimId)
-	log.Debugf("checking if %s exists", claimId)
-
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(r.(string))
-			return
-		}
-	}()
-
-	checkExistent(claimPath)
-
-	err = os.Remove(claimPath)
-	if err != nil {
-		log.Infof("deleted claim %s", claimId)
+func DeleteClaim(store ClaimStore, claimId string) (err error) {
+	log.Debugf("deleting %s", claimId)
+	if err = store.Delete(claimId); err != nil {
+		return
 	}
+
+	log.Infof("deleted claim %s", claimId)
 	return
 }
 
+// SubjectKey resolves the subject of the claim, given as PEM, JWK or did:key, to its public key
+func (c Claim) SubjectKey() (gocrypto.PublicKey, error) {
+	return crypto.DecodePublicKey(c.Sub)
+}
+
 func (c Claim) isEqual(other Claim) bool {
 	return c.Iat == other.Iat &&
 		c.Iss == other.Iss &&
@@ -192,109 +148,60 @@ func (c Claim) isEqualExceptTime(other Claim) bool {
 		c.Claim == other.Claim
 }
 
-func (c EncodedClaim) isEqual(other EncodedClaim) bool {
-	return c.EncodedData == other.EncodedData &&
-		c.Id == other.Id &&
-		c.Signature == other.Signature
+// ETag identifies the stored content of the claim, to detect concurrent changes
+func (c EncodedClaim) ETag() string {
+	return `"` + c.Hash() + `"`
 }
 
-func (c Claim) encode() (encoded string) {
-
-	mapClaims := jwt.MapClaims{
-		"iss":   c.Iss,
-		"sgk":   c.Sgk,
-		"sub":   c.Sub,
-		"iat":   c.Iat,
-		"claim": c.Claim,
-	}
-
-	encoded, err := crypto.SignJwt(mapClaims)
-
-	if err != nil {
-		log.Panicf("error encoding the claim: %s", err)
-	}
-
-	log.Info("claim encoded")
-	return
+// Hash is the base64url SHA-256 digest of the JWT, that revocation lists
+// can name the claim with
+func (c EncodedClaim) Hash() string {
+	return hashEncodedData(c.EncodedData)
 }
 
-func getPathFor(claimId string) (claimPath string) {
-
-	log.Debug("checking the path")
-	check, err := path.Match("*", claimId)
-	if err != nil {
-		log.Panicf(err.Error())
-	}
-	if !check {
-		log.Panicf("invalid claimId. Use a literal name without '/' characters instead")
-	}
-	claimPath = path.Join(CLAIM_FOLDER, claimId)
-	return
+// hashEncodedData is the base64url SHA-256 digest of the JWT, shared by the ETags,
+// the revocation lists and the attestations so they can't name a claim differently
+func hashEncodedData(encodedData string) string {
+	hash := sha256.Sum256([]byte(encodedData))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
 
-func checkNonExistent(claimPath string) {
-
-	if _, err := os.Stat(claimPath); err == nil {
-		log.Panicf("the claim %s already exists", path.Base(claimPath))
-	}
+// Decode checks the signature of the claim and reads its fields
+func (c EncodedClaim) Decode() (Claim, error) {
+	return decodeClaim(c.EncodedData)
 }
 
-func checkExistent(claimPath string) {
+func (c EncodedClaim) isEqual(other EncodedClaim) bool {
+	return c.EncodedData == other.EncodedData &&
+		c.Id == other.Id &&
+		c.Signature == other.Signature
+}
 
+// checkExistent fails with ErrClaimNotFound if there's no claim file at claimPath
+func checkExistent(claimPath string) error {
 	if _, err := os.Stat(claimPath); os.IsNotExist(err) {
-		log.Panicf("the claim %s doesn't exists", path.Base(claimPath))
+		return claimNotFound(path.Base(claimPath))
 	}
-
+	return nil
 }
 
-func (c Claim) writeInFile(claimPath string) {
-	// TODO check if better using ioutils
-	if _, err := os.Stat(CLAIM_FOLDER); os.IsNotExist(err) {
-		log.Debugf("folder %s doesn't exists. Creating %s", CLAIM_FOLDER, CLAIM_FOLDER)
-		if err = os.Mkdir(CLAIM_FOLDER, os.FileMode(os.ModePerm)); err != nil {
-			log.Panicf(err.Error())
-		}
-	}
-
-	log.Info("creating the new file")
-	file, err := os.Create(claimPath)
+// createFile writes the claim in a new file, failing with ErrClaimExists if it already exists
+func (c EncodedClaim) createFile(claimPath string) error {
+	encoded, err := json.Marshal(c)
 	if err != nil {
-		log.Panicf("error creating file %s: %s", path.Base(claimPath), err)
+		return fmt.Errorf("error encoding claim %s: %w", c.Id, err)
 	}
-	defer file.Close()
-
-	encoded := c.encode()
-
-	_, err = fmt.Fprintf(file, encoded)
-	if err != nil {
-		log.Panicf("error writing data into file %s: %s", path.Base(claimPath), err)
+	err = atomicfile.CreateFile(claimPath, encoded)
+	if os.IsExist(err) {
+		return claimExists(c.Id)
 	}
-
-	return
+	return err
 }
 
-func (c EncodedClaim) writeInFile(claimPath string) {
-	// TODO check if better using ioutils
-	if _, err := os.Stat(CLAIM_FOLDER); os.IsNotExist(err) {
-		log.Debugf("folder %s doesn't exists. Creating %s", CLAIM_FOLDER, CLAIM_FOLDER)
-		if err = os.Mkdir(CLAIM_FOLDER, os.FileMode(os.ModePerm)); err != nil {
-			log.Panicf(err.Error())
-		}
-	}
-
-	log.Info("creating the new file")
-	file, err := os.Create(claimPath)
-	if err != nil {
-		log.Panicf("error creating file %s: %s", path.Base(claimPath), err)
-	}
-	defer file.Close()
-
+func (c EncodedClaim) writeInFile(claimPath string) error {
 	encoded, err := json.Marshal(c)
-
-	_, err = fmt.Fprintf(file, string(encoded))
 	if err != nil {
-		log.Panicf("error writing data into file %s: %s", path.Base(claimPath), err)
+		return fmt.Errorf("error encoding claim %s: %w", c.Id, err)
 	}
-
-	return
+	return atomicfile.WriteFile(claimPath, encoded)
 }
@@ -16,6 +16,7 @@ type EncodedClaim struct {
 	// JWT-encoded claim
 	EncodedData string `json:"encodedData,omitempty"`
 
-	// der encoding of a typical ecdsa signature
+	// der encoding of the ecdsa signature, computed over the SHA-256 digest of the message.
+	// Raw 64 bytes signature for Ed25519 device keys
 	Signature string `json:"signature,omitempty"`
 }
@@ -0,0 +1,82 @@
+package datamodel
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrClaimNotFound means no claim is stored with the given ID
+	ErrClaimNotFound = errors.New("claim not found")
+
+	// ErrClaimDeleted means the claim was deleted, and its tombstone is still
+	// retained. It wraps ErrClaimNotFound
+	ErrClaimDeleted = fmt.Errorf("%w: deleted", ErrClaimNotFound)
+
+	// ErrVersionNotFound means the claim never had the version, or it's not retained anymore
+	ErrVersionNotFound = errors.New("claim version not found")
+
+	// ErrClaimExists means the ID is already used by another claim
+	ErrClaimExists = errors.New("claim already exists")
+
+	// ErrInvalidClaimID means the ID can't name a claim: it must be a literal
+	// name, without '/' characters
+	ErrInvalidClaimID = errors.New("invalid claimId")
+
+	// ErrMalformedClaim means the claim can't be parsed, or misses required fields
+	ErrMalformedClaim = errors.New("malformed claim")
+
+	// ErrSignatureInvalid means the JWT is not signed by its sgk
+	ErrSignatureInvalid = errors.New("invalid claim signature")
+
+	// ErrWrongSubject means the claim is about someone else than this device
+	ErrWrongSubject = errors.New("the claim is not about this device")
+
+	// ErrClaimExpired means the exp of the claim has passed
+	ErrClaimExpired = errors.New("the claim has expired")
+
+	// ErrClaimNotYetValid means the nbf of the claim has not come yet
+	ErrClaimNotYetValid = errors.New("the claim is not valid yet")
+
+	// ErrClaimRevoked means the issuer of the claim revoked it
+	ErrClaimRevoked = errors.New("the claim has been revoked")
+
+	// ErrETagMismatch means the stored claim changed since its ETag was read
+	ErrETagMismatch = errors.New("the claim doesn't match the ETag")
+
+	// ErrStaleClaim means the claim was issued before the one it would replace
+	ErrStaleClaim = errors.New("the claim is not newer than the stored one")
+
+	// ErrInvalidQuery means the claims can't be listed as asked: unknown sort
+	// field or status, or a cursor returned for another sort order
+	ErrInvalidQuery = errors.New("invalid claim query")
+)
+
+// ClaimError tells which claim an operation of the store failed on.
+// It wraps ErrClaimNotFound, ErrClaimDeleted, ErrClaimExists, ErrInvalidClaimID,
+// ErrVersionNotFound, ErrETagMismatch, ErrClaimRevoked or, for claims removed once
+// expired, ErrClaimExpired.
+type ClaimError struct {
+	ClaimId string
+	Err     error
+}
+
+func (e *ClaimError) Error() string {
+	return e.Err.Error() + ": " + e.ClaimId
+}
+
+func (e *ClaimError) Unwrap() error {
+	return e.Err
+}
+
+func invalidClaimId(claimId string) error {
+	return &ClaimError{ClaimId: claimId, Err: ErrInvalidClaimID}
+}
+
+func claimExists(claimId string) error {
+	return &ClaimError{ClaimId: claimId, Err: ErrClaimExists}
+}
+
+func claimNotFound(claimId string) error {
+	return &ClaimError{ClaimId: claimId, Err: ErrClaimNotFound}
+}
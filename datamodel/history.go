@@ -0,0 +1,128 @@
+package datamodel
+
+import (
+	"errors"
+	"time"
+)
+
+// the operations recorded in the history of a claim
+const (
+	OperationCreate    = "create"
+	OperationOverwrite = "overwrite"
+	OperationDelete    = "delete"
+
+	// the claim was removed once expired
+	OperationExpire = "expire"
+)
+
+// ClaimVersion is a content the claim had, or the tombstone of its deletion
+type ClaimVersion struct {
+	// Version counts the changes to the claim, from 1
+	Version int `json:"version"`
+
+	// StoredAt is the unix time of the change
+	StoredAt int64 `json:"storedAt"`
+
+	Operation string `json:"operation"`
+
+	// Claim is missing from tombstones
+	Claim *EncodedClaim `json:"claim,omitempty"`
+}
+
+// RetentionPolicy tells how long the stores keep the past versions of the claims.
+// The current version of a claim is always kept, while tombstones are purged
+// like the other versions, together with the history of the deleted claim.
+type RetentionPolicy struct {
+	// Versions is how many versions are kept for each claim, 0 for no limit
+	Versions int
+
+	// MaxAge is how long a version is kept after being replaced, and a
+	// tombstone after the deletion, 0 for ever
+	MaxAge time.Duration
+}
+
+// appendVersion records the operation at the end of the history
+func appendVersion(history []ClaimVersion, operation string, claim *EncodedClaim) []ClaimVersion {
+	version := 1
+	if len(history) > 0 {
+		version = history[len(history)-1].Version + 1
+	}
+	return append(history, ClaimVersion{
+		Version:   version,
+		StoredAt:  time.Now().Unix(),
+		Operation: operation,
+		Claim:     claim,
+	})
+}
+
+// retain returns the versions of the history the policy keeps at the time now
+func (p RetentionPolicy) retain(history []ClaimVersion, now time.Time) []ClaimVersion {
+	kept := history
+	if p.Versions > 0 && len(kept) > p.Versions {
+		kept = kept[len(kept)-p.Versions:]
+	}
+	if p.MaxAge > 0 {
+		oldest := now.Add(-p.MaxAge).Unix()
+		for len(kept) > 0 && replacedAt(kept) < oldest {
+			kept = kept[1:]
+		}
+	}
+	if len(kept) == 0 && len(history) > 0 && !isTombstone(history) {
+		kept = history[len(history)-1:]
+	}
+	return kept
+}
+
+// replacedAt returns when the first version of the history was replaced: when
+// the next one was stored. The last version is aged since it was stored, as it
+// can only be a tombstone or the current version, that is always kept
+func replacedAt(history []ClaimVersion) int64 {
+	if len(history) > 1 {
+		return history[1].StoredAt
+	}
+	return history[0].StoredAt
+}
+
+// isTombstone tells if the claim of the history was deleted or removed once expired
+func isTombstone(history []ClaimVersion) bool {
+	if len(history) == 0 {
+		return false
+	}
+	operation := history[len(history)-1].Operation
+	return operation == OperationDelete || operation == OperationExpire
+}
+
+// GetHistory returns the versions of the claim, the oldest first
+func GetHistory(store ClaimStore, claimId string) ([]ClaimVersion, error) {
+	return store.History(claimId)
+}
+
+// GetVersion returns the version n of the claim, if it's still retained
+func GetVersion(store ClaimStore, claimId string, n int) (version ClaimVersion, err error) {
+	history, err := store.History(claimId)
+	if err != nil {
+		return
+	}
+	for _, version = range history {
+		if version.Version == n {
+			return
+		}
+	}
+	return ClaimVersion{}, &ClaimError{ClaimId: claimId, Err: ErrVersionNotFound}
+}
+
+// tombstoneOr turns the ErrClaimNotFound of a deleted claim into ErrClaimDeleted,
+// and into ErrClaimExpired if it was removed once expired
+func tombstoneOr(store ClaimStore, claimId string, err error) error {
+	if err == nil || !errors.Is(err, ErrClaimNotFound) {
+		return err
+	}
+	history, historyErr := store.History(claimId)
+	if historyErr != nil || !isTombstone(history) {
+		return err
+	}
+	if history[len(history)-1].Operation == OperationExpire {
+		return &ClaimError{ClaimId: claimId, Err: ErrClaimExpired}
+	}
+	return &ClaimError{ClaimId: claimId, Err: ErrClaimDeleted}
+}
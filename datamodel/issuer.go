@@ -0,0 +1,231 @@
+package datamodel
+
+import (
+	gocrypto "crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/TeoSocs/alisi-client/internal/atomicfile"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIssuerNotFound = errors.New("issuer not found")
+
+	// ErrUntrustedIssuer means the iss/sgk pair of a claim is not registered,
+	// or the key was not valid when the claim was issued
+	ErrUntrustedIssuer = errors.New("untrusted issuer")
+
+	// ErrInvalidIssuer means the issuer can't be registered: its id is missing,
+	// or one of its keys is invalid
+	ErrInvalidIssuer = errors.New("invalid issuer")
+)
+
+// Issuer is an entity trusted to issue claims about the device, e.g. its manufacturer
+type Issuer struct {
+	// Iroha ID of the issuer, as found in the iss of its claims
+	Id string `json:"id"`
+
+	// Keys the issuer signs claims with
+	Keys []TrustedKey `json:"keys"`
+}
+
+// TrustedKey is a public key pinned for an issuer, with its validity window
+type TrustedKey struct {
+	// PEM, JWK or did:key public key
+	PublicKey string `json:"publicKey"`
+
+	// RFC 7638 thumbprint of the key, filled in by the registry
+	Kid string `json:"kid,omitempty"`
+
+	// Unix time since the key can issue claims, no limit if zero
+	NotBefore int64 `json:"notBefore,omitempty"`
+
+	// Unix time until the key can issue claims, no limit if zero
+	NotAfter int64 `json:"notAfter,omitempty"`
+}
+
+// validAt tells whether the key could issue claims at the given unix time
+func (k TrustedKey) validAt(unixTime int64) bool {
+	return (k.NotBefore == 0 || unixTime >= k.NotBefore) &&
+		(k.NotAfter == 0 || unixTime <= k.NotAfter)
+}
+
+// IssuerRegistry holds the trusted issuers, persisted as a JSON file
+type IssuerRegistry struct {
+	mutex   sync.RWMutex
+	path    string
+	issuers map[string]Issuer
+}
+
+// issuerRegistry is used to validate the claims. It starts empty, trusting no one
+var issuerRegistry = NewIssuerRegistry()
+
+// UseIssuerRegistry selects the registry claims are validated against
+func UseIssuerRegistry(registry *IssuerRegistry) {
+	issuerRegistry = registry
+}
+
+// TrustedIssuers returns the registry claims are validated against
+func TrustedIssuers() *IssuerRegistry {
+	return issuerRegistry
+}
+
+// NewIssuerRegistry creates an empty registry, kept in memory only
+func NewIssuerRegistry() *IssuerRegistry {
+	return &IssuerRegistry{issuers: map[string]Issuer{}}
+}
+
+// OpenIssuerRegistry loads the registry saved in the file, that is created
+// on the first change if it doesn't exist
+func OpenIssuerRegistry(path string) (registry *IssuerRegistry, err error) {
+	registry = NewIssuerRegistry()
+	registry.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("no trusted issuers in %s", path)
+		return registry, nil
+	}
+	if err != nil {
+		return
+	}
+	var issuers []Issuer
+	if err = json.Unmarshal(data, &issuers); err != nil {
+		return nil, fmt.Errorf("invalid issuer registry %s: %w", path, err)
+	}
+	for _, issuer := range issuers {
+		if issuer, err = checkIssuer(issuer); err != nil {
+			return nil, fmt.Errorf("invalid issuer registry %s: %w", path, err)
+		}
+		registry.issuers[issuer.Id] = issuer
+	}
+	log.Infof("%d trusted issuers loaded from %s", len(issuers), path)
+	return
+}
+
+// checkIssuer makes sure the keys of the issuer can be read, and sets their kid
+func checkIssuer(issuer Issuer) (checked Issuer, err error) {
+	if issuer.Id == "" {
+		err = fmt.Errorf("%w: the issuer id is missing", ErrInvalidIssuer)
+		return
+	}
+	checked = Issuer{Id: issuer.Id, Keys: []TrustedKey{}}
+	for _, key := range issuer.Keys {
+		publicKey, err := crypto.DecodePublicKey(key.PublicKey)
+		if err != nil {
+			return checked, fmt.Errorf("%w: invalid key for issuer %s: %s", ErrInvalidIssuer, issuer.Id, err)
+		}
+		if key.NotAfter != 0 && key.NotAfter < key.NotBefore {
+			return checked, fmt.Errorf("%w: key of issuer %s expires before being valid", ErrInvalidIssuer, issuer.Id)
+		}
+		key.Kid = crypto.KeyId(publicKey)
+		checked.Keys = append(checked.Keys, key)
+	}
+	return
+}
+
+// List returns the trusted issuers, sorted by id
+func (r *IssuerRegistry) List() []Issuer {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sorted()
+}
+
+// sorted lists the issuers by id. Must be called holding the mutex
+func (r *IssuerRegistry) sorted() (issuers []Issuer) {
+	issuers = make([]Issuer, 0, len(r.issuers))
+	for _, issuer := range r.issuers {
+		issuers = append(issuers, issuer)
+	}
+	sort.Slice(issuers, func(i, j int) bool {
+		return issuers[i].Id < issuers[j].Id
+	})
+	return
+}
+
+func (r *IssuerRegistry) Get(id string) (issuer Issuer, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	issuer, ok := r.issuers[id]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrIssuerNotFound, id)
+	}
+	return
+}
+
+// Put adds the issuer, or replaces the one with the same id
+func (r *IssuerRegistry) Put(issuer Issuer) (stored Issuer, err error) {
+	stored, err = checkIssuer(issuer)
+	if err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous, existed := r.issuers[stored.Id]
+	r.issuers[stored.Id] = stored
+	if err = r.save(); err != nil {
+		if existed {
+			r.issuers[stored.Id] = previous
+		} else {
+			delete(r.issuers, stored.Id)
+		}
+		return
+	}
+	log.Infof("trusted issuer %s stored", stored.Id)
+	return
+}
+
+func (r *IssuerRegistry) Delete(id string) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous, ok := r.issuers[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrIssuerNotFound, id)
+	}
+	delete(r.issuers, id)
+	if err = r.save(); err != nil {
+		r.issuers[id] = previous
+		return
+	}
+	log.Infof("trusted issuer %s deleted", id)
+	return
+}
+
+// Trusts checks that iss registered sgk as one of its keys, valid at the
+// unix time iat
+func (r *IssuerRegistry) Trusts(iss string, sgk gocrypto.PublicKey, iat int64) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	issuer, ok := r.issuers[iss]
+	if !ok {
+		return fmt.Errorf("%w: %s is not registered", ErrUntrustedIssuer, iss)
+	}
+	kid := crypto.KeyId(sgk)
+	for _, key := range issuer.Keys {
+		if key.Kid != kid {
+			continue
+		}
+		if !key.validAt(iat) {
+			return fmt.Errorf("%w: key %s of %s not valid at %s", ErrUntrustedIssuer, kid, iss, time.Unix(iat, 0).UTC())
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: key %s is not registered for %s", ErrUntrustedIssuer, kid, iss)
+}
+
+// save writes the registry to its file. Must be called holding the mutex
+func (r *IssuerRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(r.path, data)
+}
@@ -0,0 +1,68 @@
+package datamodel
+
+import (
+	"errors"
+	"time"
+)
+
+// the types of the events emitted by the device on its own
+const (
+	EventClaimExpired = "claim.expired"
+)
+
+// Event reports a change to the claims the device made on its own
+type Event struct {
+	Type    string `json:"type"`
+	ClaimId string `json:"claimId"`
+
+	// Time is the unix time of the change
+	Time int64 `json:"time"`
+}
+
+// Janitor keeps the claim store tidy: it removes the expired claims, leaving
+// their tombstone, and purges the history according to the retention policy
+type Janitor struct {
+	Store     ClaimStore
+	Retention RetentionPolicy
+
+	// Interval is the time between two sweeps
+	Interval time.Duration
+
+	// Notify is called for each claim removed. Optional
+	Notify func(Event)
+}
+
+// Run sweeps the store now, and then every Interval until stop is closed
+func (j *Janitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := j.Sweep(time.Now()); err != nil {
+			log.Errorf("error sweeping the claims: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes the claims expired at time now and purges the history.
+// It returns the IDs of the removed claims.
+func (j *Janitor) Sweep(now time.Time) (expired []string, err error) {
+	expired, err = j.Store.ExpireAll(func(current EncodedClaim) bool {
+		return errors.Is(current.ValidAt(now), ErrClaimExpired)
+	})
+	for _, claimId := range expired {
+		log.Infof("claim %s expired", claimId)
+		if j.Notify != nil {
+			j.Notify(Event{Type: EventClaimExpired, ClaimId: claimId, Time: now.Unix()})
+		}
+	}
+	if err != nil {
+		return
+	}
+	err = j.Store.Purge(j.Retention)
+	return
+}
@@ -0,0 +1,305 @@
+package datamodel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the status of a stored claim
+const (
+	StatusValid       = "valid"
+	StatusRevoked     = "revoked"
+	StatusExpired     = "expired"
+	StatusNotYetValid = "not-yet-valid"
+
+	// StatusUntrusted is the status of the claims whose issuer, or its key,
+	// was removed from the trusted issuers after they were stored
+	StatusUntrusted = "untrusted"
+)
+
+// the fields the claim list can be sorted by
+const (
+	SortById  = "id"
+	SortByIat = "iat"
+	SortByExp = "exp"
+	SortByIss = "iss"
+)
+
+// how many claims are listed per page, if not told otherwise, and at most
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ClaimSummary is an entry of the claim list: the metadata of the claim,
+// read without checking its signature again
+type ClaimSummary struct {
+	Id  string `json:"id"`
+	Iss string `json:"iss"`
+
+	// RFC 7638 thumbprint of the subject key
+	Sub string `json:"sub"`
+
+	Iat int64 `json:"iat"`
+	Nbf int64 `json:"nbf,omitempty"`
+	Exp int64 `json:"exp,omitempty"`
+
+	// Size of the JWT, in bytes
+	Size int `json:"size"`
+
+	// Status is one of valid, revoked, expired, not-yet-valid or untrusted
+	Status string `json:"status"`
+}
+
+// ClaimFilter selects the listed claims. The zero value of each field selects all of them
+type ClaimFilter struct {
+	Iss string
+
+	// Sub is the thumbprint of the subject key
+	Sub string
+
+	// IssuedAfter and IssuedBefore bound the iat, unix times included
+	IssuedAfter  int64
+	IssuedBefore int64
+
+	Status string
+}
+
+func (f ClaimFilter) matches(summary ClaimSummary) bool {
+	return (f.Iss == "" || summary.Iss == f.Iss) &&
+		(f.Sub == "" || summary.Sub == f.Sub) &&
+		(f.IssuedAfter == 0 || summary.Iat >= f.IssuedAfter) &&
+		(f.IssuedBefore == 0 || summary.Iat <= f.IssuedBefore) &&
+		(f.Status == "" || summary.Status == f.Status)
+}
+
+// ClaimQuery selects a page of the claim list
+type ClaimQuery struct {
+	ClaimFilter
+
+	// SortBy is one of the SortBy constants, SortById if empty. Ties are broken by id
+	SortBy     string
+	Descending bool
+
+	// Limit is the size of the page, DefaultListLimit if zero
+	Limit int
+
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+}
+
+// ClaimPage is a page of the claim list
+type ClaimPage struct {
+	Claims []ClaimSummary
+
+	// NextCursor selects the following page, empty on the last one
+	NextCursor string
+}
+
+// listCursor is the last claim of a page, and the order it was listed in.
+// The next page starts after it even if claims are added or removed meanwhile.
+type listCursor struct {
+	SortBy     string       `json:"sort"`
+	Descending bool         `json:"desc,omitempty"`
+	Last       ClaimSummary `json:"last"`
+}
+
+func (c listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (decoded listCursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &decoded)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: malformed cursor: %s", ErrInvalidQuery, err)
+	}
+	return
+}
+
+// ListClaims returns the page of the stored claims the query selects.
+// Files of the store that don't hold a claim are skipped.
+func ListClaims(store ClaimStore, query ClaimQuery) (page ClaimPage, err error) {
+	if query.SortBy == "" {
+		query.SortBy = SortById
+	}
+	less, err := claimOrder(query.SortBy, query.Descending)
+	if err != nil {
+		return
+	}
+	switch query.Status {
+	case "", StatusValid, StatusRevoked, StatusExpired, StatusNotYetValid, StatusUntrusted:
+	default:
+		return page, fmt.Errorf("%w: unknown status %q", ErrInvalidQuery, query.Status)
+	}
+	if query.Limit > MaxListLimit {
+		return page, fmt.Errorf("%w: at most %d claims are listed per page", ErrInvalidQuery, MaxListLimit)
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultListLimit
+	}
+	var after *ClaimSummary
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if cursor.SortBy != query.SortBy || cursor.Descending != query.Descending {
+			return page, fmt.Errorf("%w: the cursor was returned sorting by %s", ErrInvalidQuery, cursor.SortBy)
+		}
+		after = &cursor.Last
+	}
+
+	claimList, err := store.List()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	selected := []ClaimSummary{}
+	for _, claimId := range claimList {
+		claim, err := store.Get(claimId)
+		// the claim may be deleted in the meantime
+		if errors.Is(err, ErrClaimNotFound) {
+			continue
+		}
+		if err == nil && claim.Id != claimId {
+			err = fmt.Errorf("the file holds the claim %q", claim.Id)
+		}
+		if err != nil {
+			log.Warningf("%s not listed: %s", claimId, err)
+			continue
+		}
+		summary, err := claim.summary(now)
+		if err != nil {
+			log.Warningf("%s not listed: %s", claimId, err)
+			continue
+		}
+		if !query.matches(summary) || (after != nil && !less(*after, summary)) {
+			continue
+		}
+		selected = append(selected, summary)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return less(selected[i], selected[j])
+	})
+
+	page.Claims = selected
+	if len(selected) > query.Limit {
+		page.Claims = selected[:query.Limit]
+		last := page.Claims[len(page.Claims)-1]
+		page.NextCursor = listCursor{SortBy: query.SortBy, Descending: query.Descending, Last: last}.encode()
+	}
+	return
+}
+
+// claimOrder returns the order of the claim list, sorted by the field
+func claimOrder(sortBy string, descending bool) (less func(a, b ClaimSummary) bool, err error) {
+	var compare func(a, b ClaimSummary) int
+	switch sortBy {
+	case SortById:
+		compare = func(a, b ClaimSummary) int { return 0 }
+	case SortByIat:
+		compare = func(a, b ClaimSummary) int { return compareInt(a.Iat, b.Iat) }
+	case SortByExp:
+		compare = func(a, b ClaimSummary) int { return compareInt(expiry(a), expiry(b)) }
+	case SortByIss:
+		compare = func(a, b ClaimSummary) int { return strings.Compare(a.Iss, b.Iss) }
+	default:
+		return nil, fmt.Errorf("%w: can't sort by %q", ErrInvalidQuery, sortBy)
+	}
+	return func(a, b ClaimSummary) bool {
+		order := compare(a, b)
+		if order == 0 {
+			order = strings.Compare(a.Id, b.Id)
+		}
+		if descending {
+			return order > 0
+		}
+		return order < 0
+	}, nil
+}
+
+// expiry is the exp of the claim, where the claims without it expire last
+func expiry(summary ClaimSummary) int64 {
+	if summary.Exp == 0 {
+		return math.MaxInt64
+	}
+	return summary.Exp
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// ClaimStatus tells if the stored claim is valid, revoked by its issuer,
+// expired, not valid yet or no longer trusted
+func ClaimStatus(c EncodedClaim) (string, error) {
+	summary, err := c.summary(time.Now())
+	return summary.Status, err
+}
+
+// summary reads the metadata of the stored claim, that was validated when stored
+func (c EncodedClaim) summary(now time.Time) (summary ClaimSummary, err error) {
+	mapClaims, err := crypto.ReadJWT(c.EncodedData)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrMalformedClaim, err)
+		return
+	}
+	var claim Claim
+	if err = readTimes(mapClaims, &claim); err != nil {
+		return
+	}
+	claim.Iss, _ = mapClaims["iss"].(string)
+	claim.Sub, _ = mapClaims["sub"].(string)
+	summary = ClaimSummary{
+		Id:   c.Id,
+		Iss:  claim.Iss,
+		Iat:  claim.Iat,
+		Nbf:  claim.Nbf,
+		Exp:  claim.Exp,
+		Size: len(c.EncodedData),
+	}
+	if subject, err := claim.SubjectKey(); err == nil {
+		summary.Sub = crypto.KeyId(subject)
+	}
+
+	// a claim of an issuer no longer trusted can't be presented, whatever its times
+	err = trusted(mapClaims, claim.Iat)
+	if errors.Is(err, ErrUntrustedIssuer) {
+		summary.Status = StatusUntrusted
+		return summary, nil
+	}
+	if err != nil {
+		return
+	}
+	err = revocationRegistry.Check(c)
+	switch {
+	case errors.Is(err, ErrClaimRevoked):
+		summary.Status = StatusRevoked
+	case err != nil:
+		return
+	case errors.Is(claim.ValidAt(now), ErrClaimExpired):
+		summary.Status = StatusExpired
+	case errors.Is(claim.ValidAt(now), ErrClaimNotYetValid):
+		summary.Status = StatusNotYetValid
+	default:
+		summary.Status = StatusValid
+	}
+	return summary, nil
+}
@@ -0,0 +1,61 @@
+package datamodel
+
+import "sync"
+
+// idLocks gives mutual exclusion per claim ID. Locks are created on demand
+// and dropped once nobody holds them, so the map doesn't grow with the IDs
+// ever seen. The zero value is ready to use.
+type idLocks struct {
+	mutex sync.Mutex
+	locks map[string]*idLock
+}
+
+type idLock struct {
+	sync.RWMutex
+	holders int
+}
+
+// acquire returns the lock of the ID, counting the caller as a holder
+func (l *idLocks) acquire(id string) *idLock {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.locks == nil {
+		l.locks = map[string]*idLock{}
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &idLock{}
+		l.locks[id] = lock
+	}
+	lock.holders++
+	return lock
+}
+
+func (l *idLocks) release(id string, lock *idLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lock.holders--
+	if lock.holders == 0 {
+		delete(l.locks, id)
+	}
+}
+
+// lock takes the ID for writing, returning the function that releases it
+func (l *idLocks) lock(id string) (unlock func()) {
+	lock := l.acquire(id)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.release(id, lock)
+	}
+}
+
+// rlock takes the ID for reading, returning the function that releases it
+func (l *idLocks) rlock(id string) (unlock func()) {
+	lock := l.acquire(id)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		l.release(id, lock)
+	}
+}
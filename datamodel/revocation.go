@@ -0,0 +1,214 @@
+package datamodel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/TeoSocs/alisi-client/internal/atomicfile"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrInvalidRevocationList means the revocation list can't be read, or misses required fields
+	ErrInvalidRevocationList = errors.New("invalid revocation list")
+
+	// ErrStaleRevocationList means the issuer already pushed a list issued later
+	ErrStaleRevocationList = errors.New("the revocation list is not newer than the stored one")
+)
+
+// RevocationList names the claims an issuer revoked. It's pushed to the device
+// as a JWT carrying iss, sgk, iat and revoked, signed by a trusted key of the issuer.
+// Each issuer has a single list, replaced by the newer ones.
+type RevocationList struct {
+	// Iroha ID of the issuer, that can revoke only its own claims
+	Iss string `json:"iss"`
+
+	// PublicKey the list is signed with, PEM or JWK
+	Sgk string `json:"sgk"`
+
+	// Issued AT, unix time
+	Iat int64 `json:"iat"`
+
+	// Revoked holds the jti of the revoked claims, or the Hash of their JWT
+	Revoked []string `json:"revoked"`
+
+	// EncodedData is the JWT the list was read from
+	EncodedData string `json:"encodedData"`
+}
+
+// revokes tells if the list names the claim, with the given jti and hash
+func (l RevocationList) revokes(jti string, hash string) bool {
+	for _, revoked := range l.Revoked {
+		if revoked == hash || (jti != "" && revoked == jti) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeRevocationList checks the signature of the JWT against its sgk, reads
+// its fields and makes sure sgk is a trusted key of the issuer
+func DecodeRevocationList(encodedData string) (list RevocationList, err error) {
+	mapClaims, sgk, publicKey, err := verifiedJWT(encodedData, ErrInvalidRevocationList)
+	if err != nil {
+		return
+	}
+	list = RevocationList{Sgk: sgk, EncodedData: encodedData, Revoked: []string{}}
+	iss, ok := mapClaims["iss"].(string)
+	if !ok || iss == "" {
+		err = fmt.Errorf("%w: iss must be a non-empty string", ErrInvalidRevocationList)
+		return
+	}
+	list.Iss = iss
+	iat, ok := mapClaims["iat"].(float64)
+	if !ok {
+		err = fmt.Errorf("%w: iat must be a number", ErrInvalidRevocationList)
+		return
+	}
+	list.Iat = int64(iat)
+	revoked, ok := mapClaims["revoked"].([]interface{})
+	if !ok {
+		err = fmt.Errorf("%w: revoked must be an array", ErrInvalidRevocationList)
+		return
+	}
+	for _, entry := range revoked {
+		value, ok := entry.(string)
+		if !ok || value == "" {
+			err = fmt.Errorf("%w: revoked must hold non-empty strings", ErrInvalidRevocationList)
+			return
+		}
+		list.Revoked = append(list.Revoked, value)
+	}
+
+	err = issuerRegistry.Trusts(list.Iss, publicKey, list.Iat)
+	return
+}
+
+// RevocationRegistry holds the last revocation list of each issuer, persisted as a JSON file
+type RevocationRegistry struct {
+	mutex sync.RWMutex
+	path  string
+	lists map[string]RevocationList
+}
+
+// revocationRegistry is checked before presenting the claims. It starts empty
+var revocationRegistry = NewRevocationRegistry()
+
+// UseRevocationRegistry selects the registry the claims are checked against
+func UseRevocationRegistry(registry *RevocationRegistry) {
+	revocationRegistry = registry
+}
+
+// Revocations returns the registry the claims are checked against
+func Revocations() *RevocationRegistry {
+	return revocationRegistry
+}
+
+// NewRevocationRegistry creates an empty registry, kept in memory only
+func NewRevocationRegistry() *RevocationRegistry {
+	return &RevocationRegistry{lists: map[string]RevocationList{}}
+}
+
+// OpenRevocationRegistry loads the registry saved in the file, that is created
+// on the first push if it doesn't exist. The lists were verified when pushed,
+// and are kept even if their issuer is not trusted anymore.
+func OpenRevocationRegistry(path string) (registry *RevocationRegistry, err error) {
+	registry = NewRevocationRegistry()
+	registry.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("no revocation lists in %s", path)
+		return registry, nil
+	}
+	if err != nil {
+		return
+	}
+	var lists []RevocationList
+	if err = json.Unmarshal(data, &lists); err != nil {
+		return nil, fmt.Errorf("invalid revocation registry %s: %w", path, err)
+	}
+	for _, list := range lists {
+		registry.lists[list.Iss] = list
+	}
+	log.Infof("%d revocation lists loaded from %s", len(lists), path)
+	return
+}
+
+// Push stores the list, replacing the one of the same issuer if older
+func (r *RevocationRegistry) Push(encodedData string) (list RevocationList, err error) {
+	list, err = DecodeRevocationList(encodedData)
+	if err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous, existed := r.lists[list.Iss]
+	if existed && list.Iat <= previous.Iat {
+		err = fmt.Errorf("%w: iat %d, stored list of %s issued at %d", ErrStaleRevocationList, list.Iat, list.Iss, previous.Iat)
+		return
+	}
+	r.lists[list.Iss] = list
+	if err = r.save(); err != nil {
+		if existed {
+			r.lists[list.Iss] = previous
+		} else {
+			delete(r.lists, list.Iss)
+		}
+		return
+	}
+	log.Infof("revocation list of %s stored: %d claims revoked", list.Iss, len(list.Revoked))
+	return
+}
+
+// List returns the revocation lists, sorted by issuer
+func (r *RevocationRegistry) List() []RevocationList {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sorted()
+}
+
+// sorted lists the revocation lists by issuer. Must be called holding the mutex
+func (r *RevocationRegistry) sorted() (lists []RevocationList) {
+	lists = make([]RevocationList, 0, len(r.lists))
+	for _, list := range r.lists {
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		return lists[i].Iss < lists[j].Iss
+	})
+	return
+}
+
+// Check fails with ErrClaimRevoked if the issuer of the stored claim revoked it.
+// The signature is not checked again: the claim was validated when stored.
+func (r *RevocationRegistry) Check(c EncodedClaim) error {
+	mapClaims, err := crypto.ReadJWT(c.EncodedData)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedClaim, err)
+	}
+	iss, _ := mapClaims["iss"].(string)
+	jti, _ := mapClaims["jti"].(string)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	list, ok := r.lists[iss]
+	if ok && list.revokes(jti, c.Hash()) {
+		return &ClaimError{ClaimId: c.Id, Err: ErrClaimRevoked}
+	}
+	return nil
+}
+
+// save writes the registry to its file. Must be called holding the mutex
+func (r *RevocationRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(r.path, data)
+}
@@ -0,0 +1,586 @@
+package datamodel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/internal/atomicfile"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClaimStore persists the encoded claims by ID. It doesn't validate them:
+// that's done by CreateAndStore before storing.
+type ClaimStore interface {
+	// Create stores a new claim, failing if its ID is already in use
+	Create(claim EncodedClaim) error
+
+	// Overwrite replaces an existing claim
+	Overwrite(claim EncodedClaim) error
+
+	// Update replaces the claim with the one returned by update, called with
+	// the stored claim. No other change to the claim can happen in between.
+	// If update fails, the stored claim is left as it is.
+	Update(claimId string, update func(current EncodedClaim) (EncodedClaim, error)) error
+
+	Get(claimId string) (EncodedClaim, error)
+
+	// List returns the IDs of the stored claims, sorted
+	List() ([]string, error)
+
+	// Delete removes the claim, leaving a tombstone in its history
+	Delete(claimId string) error
+
+	// ExpireAll removes in one pass the claims expired says so when called with
+	// them, recording the expiry in their history. It returns the removed IDs.
+	ExpireAll(expired func(current EncodedClaim) bool) ([]string, error)
+
+	// History returns the retained versions of the claim, the oldest first.
+	// After a deletion, the last one is the tombstone.
+	History(claimId string) ([]ClaimVersion, error)
+
+	// Purge forgets the versions that the policy doesn't retain
+	Purge(policy RetentionPolicy) error
+}
+
+// OpenClaimStore opens the store of the given backend: "dir" keeps a file per
+// claim in the location folder, "bolt" a bbolt database in the location file
+// and "memory" keeps the claims until the process exits.
+func OpenClaimStore(backend string, location string) (ClaimStore, error) {
+	switch backend {
+	case "dir":
+		store := NewDirStore(location)
+		quarantined, err := store.Recover()
+		if err != nil {
+			return nil, err
+		}
+		if len(quarantined) > 0 {
+			log.Warningf("%d unreadable claims moved to %s: %v", len(quarantined), path.Join(location, quarantineFolder), quarantined)
+		}
+		return store, nil
+	case "bolt":
+		return OpenBoltStore(location)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown claim store %q", backend)
+}
+
+func checkClaimId(claimId string) error {
+	check, err := path.Match("*", claimId)
+	if err != nil {
+		return err
+	}
+	if !check || claimId == "" {
+		return invalidClaimId(claimId)
+	}
+	return nil
+}
+
+// checkSameId makes sure an update doesn't move the claim to another ID
+func checkSameId(claimId string, updated EncodedClaim) error {
+	if updated.Id != claimId {
+		return fmt.Errorf("the update of claim %s changes its ID to %s", claimId, updated.Id)
+	}
+	return nil
+}
+
+// unreadable claim files are moved here by DirStore.Recover
+const quarantineFolder = ".quarantine"
+
+// the history of each claim is kept in a file of this subfolder, named after the claim
+const historyFolder = ".history"
+
+// DirStore keeps each claim as a JSON file named after its ID.
+// Files are replaced atomically, so a crash leaves either the old claim or the new one.
+type DirStore struct {
+	Folder string
+
+	// locks serializes the operations on the same claim
+	locks idLocks
+}
+
+func NewDirStore(folder string) *DirStore {
+	return &DirStore{Folder: folder}
+}
+
+func (s *DirStore) Create(c EncodedClaim) (err error) {
+	claimPath, err := s.getPathFor(c.Id)
+	if err != nil {
+		return
+	}
+	defer s.locks.lock(c.Id)()
+	if err = c.createFile(claimPath); err != nil {
+		return
+	}
+	return s.record(c.Id, OperationCreate, &c)
+}
+
+func (s *DirStore) Overwrite(c EncodedClaim) (err error) {
+	claimPath, err := s.getPathFor(c.Id)
+	if err != nil {
+		return
+	}
+	defer s.locks.lock(c.Id)()
+	if err = checkExistent(claimPath); err != nil {
+		return
+	}
+	if err = c.writeInFile(claimPath); err != nil {
+		return
+	}
+	return s.record(c.Id, OperationOverwrite, &c)
+}
+
+func (s *DirStore) Update(claimId string, update func(current EncodedClaim) (EncodedClaim, error)) (err error) {
+	claimPath, err := s.getPathFor(claimId)
+	if err != nil {
+		return
+	}
+	defer s.locks.lock(claimId)()
+	current, err := s.read(claimId, claimPath)
+	if err != nil {
+		return
+	}
+	updated, err := update(current)
+	if err != nil {
+		return
+	}
+	if err = checkSameId(claimId, updated); err != nil {
+		return
+	}
+	if err = updated.writeInFile(claimPath); err != nil {
+		return
+	}
+	return s.record(claimId, OperationOverwrite, &updated)
+}
+
+func (s *DirStore) Get(claimId string) (claim EncodedClaim, err error) {
+	claimPath, err := s.getPathFor(claimId)
+	if err != nil {
+		return
+	}
+	defer s.locks.rlock(claimId)()
+	return s.read(claimId, claimPath)
+}
+
+// read decodes the claim file. Must be called holding the lock of the claim
+func (s *DirStore) read(claimId string, claimPath string) (claim EncodedClaim, err error) {
+	log.Debugf("retrieving claim from %s", claimPath)
+	data, err := ioutil.ReadFile(claimPath)
+	if os.IsNotExist(err) {
+		err = claimNotFound(claimId)
+		return
+	}
+	if err != nil {
+		log.Errorf("error reading file %s: %s", path.Base(claimPath), err)
+		return
+	}
+	err = json.Unmarshal(data, &claim)
+	if err != nil {
+		log.Errorf("error decoding JWT: %s", err)
+	}
+	return
+}
+
+func (s *DirStore) List() (claimList []string, err error) {
+	if _, err = os.Stat(s.Folder); os.IsNotExist(err) {
+		log.Debugf("folder %s doesn't exists. Creating %s", s.Folder, s.Folder)
+		err = os.Mkdir(s.Folder, os.FileMode(os.ModePerm))
+	}
+
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	fileInfoList, err := ioutil.ReadDir(s.Folder)
+	if err != nil {
+		return
+	}
+	claimList = []string{}
+	for _, fInfo := range fileInfoList {
+		// temp and quarantined files are kept in subfolders
+		if !fInfo.Mode().IsRegular() {
+			continue
+		}
+		claimList = append(claimList, fInfo.Name())
+	}
+	return
+}
+
+func (s *DirStore) Delete(claimId string) error {
+	_, err := s.remove(claimId, OperationDelete, nil)
+	return err
+}
+
+func (s *DirStore) ExpireAll(expired func(current EncodedClaim) bool) (removedIds []string, err error) {
+	claimList, err := s.List()
+	if err != nil {
+		return
+	}
+	for _, claimId := range claimList {
+		// only the expired claims are written, each under its lock
+		removed, err := s.remove(claimId, OperationExpire, expired)
+		// the claim may be deleted in the meantime
+		if errors.Is(err, ErrClaimNotFound) {
+			continue
+		}
+		if err != nil {
+			return removedIds, err
+		}
+		if removed {
+			removedIds = append(removedIds, claimId)
+		}
+	}
+	return
+}
+
+// remove deletes the claim file, if there's no check or it passes, and records
+// the operation in the history
+func (s *DirStore) remove(claimId string, operation string, check func(current EncodedClaim) bool) (removed bool, err error) {
+	claimPath, err := s.getPathFor(claimId)
+	if err != nil {
+		return
+	}
+	defer s.locks.lock(claimId)()
+	if check != nil {
+		current, err := s.read(claimId, claimPath)
+		if err != nil || !check(current) {
+			return false, err
+		}
+	}
+	err = os.Remove(claimPath)
+	if os.IsNotExist(err) {
+		err = claimNotFound(claimId)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err = atomicfile.SyncDir(s.Folder); err != nil {
+		return
+	}
+	return true, s.record(claimId, operation, nil)
+}
+
+func (s *DirStore) History(claimId string) (history []ClaimVersion, err error) {
+	claimPath, err := s.getPathFor(claimId)
+	if err != nil {
+		return
+	}
+	defer s.locks.rlock(claimId)()
+	history, err = s.readHistory(claimId)
+	if err != nil || len(history) > 0 {
+		return
+	}
+	// claims stored before the history was kept have none
+	if err = checkExistent(claimPath); err != nil {
+		return
+	}
+	return []ClaimVersion{}, nil
+}
+
+func (s *DirStore) Purge(policy RetentionPolicy) (err error) {
+	fileInfoList, err := ioutil.ReadDir(path.Join(s.Folder, historyFolder))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	for _, fInfo := range fileInfoList {
+		if fInfo.IsDir() {
+			continue
+		}
+		if err = s.purge(fInfo.Name(), policy); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// purge applies the policy to the history of the claim
+func (s *DirStore) purge(claimId string, policy RetentionPolicy) (err error) {
+	defer s.locks.lock(claimId)()
+	history, err := s.readHistory(claimId)
+	if err != nil {
+		return
+	}
+	kept := policy.retain(history, time.Now())
+	if len(kept) == len(history) {
+		return
+	}
+	log.Debugf("%d versions of claim %s purged", len(history)-len(kept), claimId)
+	historyPath := path.Join(s.Folder, historyFolder, claimId)
+	if len(kept) > 0 {
+		return writeHistory(historyPath, kept)
+	}
+	if err = os.Remove(historyPath); err != nil {
+		return
+	}
+	return atomicfile.SyncDir(path.Dir(historyPath))
+}
+
+// readHistory reads the history file of the claim, if any. Must be called
+// holding the lock of the claim
+func (s *DirStore) readHistory(claimId string) (history []ClaimVersion, err error) {
+	data, err := ioutil.ReadFile(path.Join(s.Folder, historyFolder, claimId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &history)
+	return
+}
+
+// record adds the operation to the history of the claim. Must be called
+// holding the lock of the claim
+func (s *DirStore) record(claimId string, operation string, claim *EncodedClaim) error {
+	history, err := s.readHistory(claimId)
+	if err != nil {
+		return err
+	}
+	history = appendVersion(history, operation, claim)
+	return writeHistory(path.Join(s.Folder, historyFolder, claimId), history)
+}
+
+func writeHistory(historyPath string, history []ClaimVersion) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(historyPath, data)
+}
+
+func (s *DirStore) getPathFor(claimId string) (claimPath string, err error) {
+
+	log.Debug("checking the path")
+	if err = checkClaimId(claimId); err != nil {
+		return
+	}
+	// the subfolders of the store are not claims
+	if claimId == atomicfile.TempFolder || claimId == quarantineFolder || claimId == historyFolder {
+		err = invalidClaimId(claimId)
+		return
+	}
+	claimPath = path.Join(s.Folder, claimId)
+	return
+}
+
+// Recover checks every claim file, moving the ones that can't be read to the
+// quarantine subfolder so that they don't break reads. It returns the names
+// of the quarantined files. Leftover temp files of interrupted writes are removed.
+func (s *DirStore) Recover() (quarantined []string, err error) {
+	if err = os.RemoveAll(path.Join(s.Folder, atomicfile.TempFolder)); err != nil {
+		return
+	}
+	if err = os.RemoveAll(path.Join(s.Folder, historyFolder, atomicfile.TempFolder)); err != nil {
+		return
+	}
+	fileInfoList, err := ioutil.ReadDir(s.Folder)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, fInfo := range fileInfoList {
+		if fInfo.IsDir() {
+			continue
+		}
+		reason := checkClaimFile(path.Join(s.Folder, fInfo.Name()))
+		if reason == nil {
+			continue
+		}
+		log.Warningf("claim file %s quarantined: %s", fInfo.Name(), reason)
+		if err = s.quarantine(fInfo.Name()); err != nil {
+			return
+		}
+		quarantined = append(quarantined, fInfo.Name())
+	}
+	if len(quarantined) > 0 {
+		err = atomicfile.SyncDir(s.Folder)
+	}
+	return
+}
+
+// checkClaimFile tells why the file doesn't hold a readable claim, nil if it does
+func checkClaimFile(claimPath string) error {
+	data, err := ioutil.ReadFile(claimPath)
+	if err != nil {
+		return err
+	}
+	var claim EncodedClaim
+	if err = json.Unmarshal(data, &claim); err != nil {
+		return err
+	}
+	if claim.Id != path.Base(claimPath) {
+		return fmt.Errorf("the file holds the claim %q", claim.Id)
+	}
+	if claim.EncodedData == "" {
+		return errors.New("encodedData is missing")
+	}
+	return nil
+}
+
+// quarantine moves the file aside, with a timestamp in case it happens twice
+func (s *DirStore) quarantine(name string) error {
+	quarantinePath := path.Join(s.Folder, quarantineFolder)
+	if err := os.MkdirAll(quarantinePath, 0700); err != nil {
+		return err
+	}
+	target := fmt.Sprintf("%s.%d", name, time.Now().UnixNano())
+	return os.Rename(path.Join(s.Folder, name), path.Join(quarantinePath, target))
+}
+
+// MemoryStore keeps the claims in memory, for tests and ephemeral devices
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	claims  map[string]EncodedClaim
+	history map[string][]ClaimVersion
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		claims:  map[string]EncodedClaim{},
+		history: map[string][]ClaimVersion{},
+	}
+}
+
+func (s *MemoryStore) Create(c EncodedClaim) error {
+	if err := checkClaimId(c.Id); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.claims[c.Id]; ok {
+		return claimExists(c.Id)
+	}
+	s.claims[c.Id] = c
+	s.history[c.Id] = appendVersion(s.history[c.Id], OperationCreate, &c)
+	return nil
+}
+
+func (s *MemoryStore) Overwrite(c EncodedClaim) error {
+	if err := checkClaimId(c.Id); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.claims[c.Id]; !ok {
+		return claimNotFound(c.Id)
+	}
+	s.claims[c.Id] = c
+	s.history[c.Id] = appendVersion(s.history[c.Id], OperationOverwrite, &c)
+	return nil
+}
+
+func (s *MemoryStore) Update(claimId string, update func(current EncodedClaim) (EncodedClaim, error)) error {
+	if err := checkClaimId(claimId); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.claims[claimId]
+	if !ok {
+		return claimNotFound(claimId)
+	}
+	updated, err := update(current)
+	if err != nil {
+		return err
+	}
+	if err = checkSameId(claimId, updated); err != nil {
+		return err
+	}
+	s.claims[claimId] = updated
+	s.history[claimId] = appendVersion(s.history[claimId], OperationOverwrite, &updated)
+	return nil
+}
+
+func (s *MemoryStore) Get(claimId string) (EncodedClaim, error) {
+	if err := checkClaimId(claimId); err != nil {
+		return EncodedClaim{}, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	claim, ok := s.claims[claimId]
+	if !ok {
+		return EncodedClaim{}, claimNotFound(claimId)
+	}
+	return claim, nil
+}
+
+func (s *MemoryStore) List() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	claimList := make([]string, 0, len(s.claims))
+	for claimId := range s.claims {
+		claimList = append(claimList, claimId)
+	}
+	sort.Strings(claimList)
+	return claimList, nil
+}
+
+func (s *MemoryStore) Delete(claimId string) error {
+	if err := checkClaimId(claimId); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.claims[claimId]; !ok {
+		return claimNotFound(claimId)
+	}
+	delete(s.claims, claimId)
+	s.history[claimId] = appendVersion(s.history[claimId], OperationDelete, nil)
+	return nil
+}
+
+func (s *MemoryStore) ExpireAll(expired func(current EncodedClaim) bool) (removedIds []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for claimId, current := range s.claims {
+		if !expired(current) {
+			continue
+		}
+		delete(s.claims, claimId)
+		s.history[claimId] = appendVersion(s.history[claimId], OperationExpire, nil)
+		removedIds = append(removedIds, claimId)
+	}
+	sort.Strings(removedIds)
+	return
+}
+
+func (s *MemoryStore) History(claimId string) ([]ClaimVersion, error) {
+	if err := checkClaimId(claimId); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	history, ok := s.history[claimId]
+	if !ok {
+		return nil, claimNotFound(claimId)
+	}
+	// the caller can't change the stored versions
+	return append([]ClaimVersion{}, history...), nil
+}
+
+func (s *MemoryStore) Purge(policy RetentionPolicy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for claimId, history := range s.history {
+		kept := policy.retain(history, now)
+		if len(kept) == 0 {
+			delete(s.history, claimId)
+			continue
+		}
+		s.history[claimId] = kept
+	}
+	return nil
+}
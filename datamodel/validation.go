@@ -0,0 +1,206 @@
+package datamodel
+
+import (
+	gocrypto "crypto"
+	"errors"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/dgrijalva/jwt-go"
+	"time"
+)
+
+// Validate checks the claim before it's stored: the JWT must be signed by its
+// sgk, a key registered for the issuer, carry the required fields, have this
+// device as subject and not be expired. The errors wrap ErrMalformedClaim,
+// ErrSignatureInvalid, ErrUntrustedIssuer, ErrWrongSubject or ErrClaimExpired.
+func (c EncodedClaim) Validate() (claim Claim, err error) {
+	claim, err = decodeClaim(c.EncodedData)
+	if err != nil {
+		return
+	}
+	// claims not valid yet are stored, to be presented once they are
+	if err = claim.ValidAt(time.Now()); errors.Is(err, ErrClaimExpired) {
+		return
+	}
+	subject, err := claim.SubjectKey()
+	if err != nil {
+		err = fmt.Errorf("%w: invalid sub: %s", ErrMalformedClaim, err)
+		return
+	}
+	isDevice, err := crypto.IsDeviceKey(subject)
+	if err != nil {
+		return
+	}
+	if !isDevice {
+		err = fmt.Errorf("%w: sub %s is not a key of the device", ErrWrongSubject, crypto.KeyId(subject))
+	}
+	return
+}
+
+// decodeClaim checks the signature of the JWT against its sgk, reads its fields
+// and makes sure sgk is a trusted key of the issuer
+func decodeClaim(encodedData string) (claim Claim, err error) {
+	mapClaims, sgk, publicKey, err := verifiedJWT(encodedData, ErrMalformedClaim)
+	if err != nil {
+		return
+	}
+
+	claim.Sgk = sgk
+	if claim.Iss, err = stringField(mapClaims, "iss"); err != nil {
+		return
+	}
+	if claim.Sub, err = stringField(mapClaims, "sub"); err != nil {
+		return
+	}
+	if claim.Claim, err = stringField(mapClaims, "claim"); err != nil {
+		return
+	}
+	if claim.Jti, err = optionalStringField(mapClaims, "jti"); err != nil {
+		return
+	}
+	if err = readTimes(mapClaims, &claim); err != nil {
+		return
+	}
+
+	err = issuerRegistry.Trusts(claim.Iss, publicKey, claim.Iat)
+	return
+}
+
+// CheckTrust fails with ErrUntrustedIssuer if the issuer doesn't trust the sgk of
+// the stored claim anymore: the issuer, or its key, may have been removed since
+// the claim was stored. The signature is not checked again.
+func (c EncodedClaim) CheckTrust() error {
+	mapClaims, err := crypto.ReadJWT(c.EncodedData)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedClaim, err)
+	}
+	var claim Claim
+	if err = readTimes(mapClaims, &claim); err != nil {
+		return err
+	}
+	return trusted(mapClaims, claim.Iat)
+}
+
+// trusted checks that the iss of the JWT trusts its sgk, at the unix time iat
+func trusted(mapClaims jwt.MapClaims, iat int64) error {
+	iss, _ := mapClaims["iss"].(string)
+	sgk, _ := mapClaims["sgk"].(string)
+	publicKey, err := crypto.DecodePublicKey(sgk)
+	if err != nil {
+		return fmt.Errorf("%w: invalid sgk: %s", ErrMalformedClaim, err)
+	}
+	return issuerRegistry.Trusts(iss, publicKey, iat)
+}
+
+// verifiedJWT checks the signature of the JWT against the key in its sgk, that is
+// returned with the payload. The errors about the format of the JWT wrap malformed.
+func verifiedJWT(encodedData string, malformed error) (mapClaims jwt.MapClaims, sgk string, publicKey gocrypto.PublicKey, err error) {
+	if encodedData == "" {
+		err = fmt.Errorf("%w: encodedData is missing", malformed)
+		return
+	}
+	unverified, err := crypto.ReadJWT(encodedData)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", malformed, err)
+		return
+	}
+	sgk, ok := unverified["sgk"].(string)
+	if !ok {
+		err = fmt.Errorf("%w: sgk must be a string", malformed)
+		return
+	}
+	publicKey, err = crypto.DecodePublicKey(sgk)
+	if err != nil {
+		err = fmt.Errorf("%w: invalid sgk: %s", malformed, err)
+		return
+	}
+	mapClaims, err = crypto.CheckJWTSignature(encodedData, publicKey)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+	return
+}
+
+// readTimes sets iat, which is required, and the optional nbf and exp of the claim
+func readTimes(mapClaims jwt.MapClaims, claim *Claim) (err error) {
+	iat, ok := mapClaims["iat"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: iat must be a number", ErrMalformedClaim)
+	}
+	claim.Iat = int64(iat)
+	if claim.Nbf, err = optionalTimeField(mapClaims, "nbf"); err != nil {
+		return
+	}
+	if claim.Exp, err = optionalTimeField(mapClaims, "exp"); err != nil {
+		return
+	}
+	if claim.Exp != 0 && claim.Exp <= claim.Nbf {
+		return fmt.Errorf("%w: exp must follow nbf", ErrMalformedClaim)
+	}
+	return
+}
+
+func optionalTimeField(mapClaims jwt.MapClaims, name string) (value int64, err error) {
+	field, ok := mapClaims[name]
+	if !ok {
+		return
+	}
+	number, ok := field.(float64)
+	if !ok {
+		err = fmt.Errorf("%w: %s must be a number", ErrMalformedClaim, name)
+	}
+	return int64(number), err
+}
+
+// ValidAt fails with ErrClaimNotYetValid or ErrClaimExpired if the claim can't
+// be presented at time t
+func (c Claim) ValidAt(t time.Time) error {
+	now := t.Unix()
+	if c.Nbf != 0 && now < c.Nbf {
+		return fmt.Errorf("%w: valid from %d", ErrClaimNotYetValid, c.Nbf)
+	}
+	if c.Exp != 0 && now >= c.Exp {
+		return fmt.Errorf("%w: expired at %d", ErrClaimExpired, c.Exp)
+	}
+	return nil
+}
+
+// ValidAt is like Claim.ValidAt, for a stored claim
+func (c EncodedClaim) ValidAt(t time.Time) error {
+	claim, err := c.times()
+	if err != nil {
+		return err
+	}
+	return claim.ValidAt(t)
+}
+
+// times reads iat, nbf and exp of a stored claim. The signature is not checked again:
+// the claim was validated when stored, and its issuer may not be trusted anymore.
+func (c EncodedClaim) times() (claim Claim, err error) {
+	mapClaims, err := crypto.ReadJWT(c.EncodedData)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrMalformedClaim, err)
+		return
+	}
+	err = readTimes(mapClaims, &claim)
+	return
+}
+
+func stringField(mapClaims jwt.MapClaims, name string) (value string, err error) {
+	value, ok := mapClaims[name].(string)
+	if !ok || value == "" {
+		err = fmt.Errorf("%w: %s must be a non-empty string", ErrMalformedClaim, name)
+	}
+	return
+}
+
+func optionalStringField(mapClaims jwt.MapClaims, name string) (value string, err error) {
+	field, ok := mapClaims[name]
+	if !ok {
+		return
+	}
+	if value, ok = field.(string); !ok {
+		err = fmt.Errorf("%w: %s must be a string", ErrMalformedClaim, name)
+	}
+	return
+}
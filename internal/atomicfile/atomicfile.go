@@ -0,0 +1,114 @@
+// Package atomicfile writes files so that a crash or a power loss leaves
+// either the old content or the new one, never a partial file
+package atomicfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// TempFolder is the subfolder the temp files are written in, next to their
+// target: folders listing their files, like the claim store, skip it
+const TempFolder = ".tmp"
+
+// WriteFile replaces the file with data: the data is written and synced
+// to a temp file, that is then renamed over the file. The folder is synced too,
+// so that the rename survives a power loss.
+func WriteFile(filePath string, data []byte) (err error) {
+	tempName, err := writeTempFile(filePath, data)
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tempName, filePath); err != nil {
+		_ = os.Remove(tempName)
+		return
+	}
+	return SyncDir(path.Dir(filePath))
+}
+
+// link is os.Link, replaced in the tests to mimic filesystems without hard links
+var link = os.Link
+
+// CreateFile is like WriteFile, but fails with an error satisfying
+// os.IsExist if the file already exists, like O_EXCL. The temp file is hard linked
+// in place, that unlike rename never replaces the target. On filesystems without
+// hard links, like FAT, the file is created with O_EXCL and written in place
+// instead: a crash may then leave it partially written.
+func CreateFile(filePath string, data []byte) (err error) {
+	tempName, err := writeTempFile(filePath, data)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tempName)
+	err = link(tempName, filePath)
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+		err = createExclusive(filePath, data)
+	}
+	if err != nil {
+		return
+	}
+	return SyncDir(path.Dir(filePath))
+}
+
+// createExclusive writes and syncs data to a new file, removing it if it
+// can't be written completely
+func createExclusive(filePath string, data []byte) (err error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(filePath)
+	}
+	return
+}
+
+// writeTempFile writes and syncs data to a new temp file, readable by the
+// owner only, in the TempFolder next to filePath
+func writeTempFile(filePath string, data []byte) (tempName string, err error) {
+	folder := path.Dir(filePath)
+	tempPath := path.Join(folder, TempFolder)
+	if err = os.MkdirAll(folder, os.ModePerm); err != nil {
+		return
+	}
+	if err = os.MkdirAll(tempPath, 0700); err != nil {
+		return
+	}
+	temp, err := ioutil.TempFile(tempPath, path.Base(filePath)+".*")
+	if err != nil {
+		return
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return
+	}
+	tempName = temp.Name()
+	return
+}
+
+// SyncDir flushes the folder entries, making renames and removals durable
+func SyncDir(folder string) error {
+	dir, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,92 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "registry.json")
+	for _, content := range []string{"[]", `[{"id": "issuer"}]`} {
+		if err := WriteFile(filePath, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("%q read, %q written", data, content)
+		}
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file written with mode %v, 0600 expected", info.Mode().Perm())
+	}
+	leftovers, err := ioutil.ReadDir(path.Join(path.Dir(filePath), TempFolder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) > 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "claim")
+	if err := CreateFile(filePath, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateFile(filePath, []byte("second")); !os.IsExist(err) {
+		t.Fatalf("got %v creating the file twice, an os.IsExist error expected", err)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first" {
+		t.Errorf("existing file replaced with %q", data)
+	}
+}
+
+func TestCreateFileWithoutLinks(t *testing.T) {
+	link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	defer func() { link = os.Link }()
+
+	filePath := path.Join(t.TempDir(), "claim")
+	if err := CreateFile(filePath, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateFile(filePath, []byte("second")); !os.IsExist(err) {
+		t.Fatalf("got %v creating the file twice, an os.IsExist error expected", err)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first" {
+		t.Errorf("existing file replaced with %q", data)
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file created with mode %v, 0600 expected", info.Mode().Perm())
+	}
+	leftovers, err := ioutil.ReadDir(path.Join(path.Dir(filePath), TempFolder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) > 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
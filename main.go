@@ -11,23 +11,213 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/auth"
+	"github.com/TeoSocs/alisi-client/config"
 	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/TeoSocs/alisi-client/datamodel"
 	"github.com/op/go-logging"
-	"net/http"
+	"io/ioutil"
+	"strings"
+	"time"
 
 	sw "github.com/TeoSocs/alisi-client/swagger"
 )
 
+var log = logging.MustGetLogger("alisi")
+
+// settings are bound to the flags, and overlaid by the file and the environment in main
+var settings = config.Default()
+
+func init() {
+	settings.RegisterFlags(flag.CommandLine)
+}
+
 func main() {
 
-	var log = logging.MustGetLogger("alisi")
+	flag.Parse()
+	if err := settings.Load(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	level, _ := logging.LogLevel(settings.LogLevel)
+	logging.SetLevel(level, "alisi")
+	// the keys stored in clear can't be loaded once a passphrase is configured
+	if flag.Arg(0) == "encrypt-key" {
+		encryptKey()
+		return
+	}
+	if err := crypto.Configure(settings.Keys); errors.Is(err, crypto.ErrNotEncrypted) {
+		log.Fatalf("can't load the device key: %s. Encrypt it with the encrypt-key command", err)
+	} else if err != nil {
+		log.Fatalf("can't load the device key: %s", err)
+	}
+	if err := datamodel.Configure(settings.Claims); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.Configure(settings.Auth); err != nil {
+		log.Fatal(err)
+	}
 
-	crypto.TEST_ENV = true
-	crypto.Init()
+	switch flag.Arg(0) {
+	case "":
+	case "rotate-key":
+		rotateKey()
+		return
+	case "request-certificate":
+		requestCertificate(flag.Args()[1:])
+		return
+	case "install-certificate":
+		installCertificate(flag.Arg(1))
+		return
+	case "create-api-key":
+		createAPIKey(flag.Args()[1:])
+		return
+	case "list-api-keys":
+		listAPIKeys()
+		return
+	case "rotate-api-key":
+		rotateAPIKey(flag.Arg(1))
+		return
+	case "revoke-api-key":
+		if err := auth.Keys().Revoke(flag.Arg(1)); err != nil {
+			log.Fatalf("error revoking the API key: %s", err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %s", flag.Arg(0))
+	}
 
 	log.Info("Server started")
+	if len(auth.Keys().List()) == 0 {
+		log.Warning("no API keys: create one with the create-api-key command")
+	}
+
+	claims, err := datamodel.OpenConfiguredStore(settings.Claims)
+	if err != nil {
+		log.Fatal(err)
+	}
+	janitor := datamodel.NewJanitor(claims, settings.Claims)
+	janitor.Notify = func(event datamodel.Event) {
+		log.Noticef("%s: %s", event.Type, event.ClaimId)
+	}
+	go janitor.Run(nil)
+	log.Fatal(sw.ListenAndServe(settings.Server, sw.NewRouter(claims)))
+}
+
+// rotateKey replaces the device key and prints the handover statement
+func rotateKey() {
+	retired, err := crypto.RotateKey()
+	if err != nil {
+		log.Fatalf("error rotating the key: %s", err)
+	}
+	fmt.Printf("key %s retired, new key %s\n", retired.KeyId, retired.Successor)
+	fmt.Println(retired.Handover)
+}
+
+// encryptKey encrypts the device key stored in clear with the configured passphrase
+func encryptKey() {
+	keyIds, err := crypto.EncryptKeys(settings.Keys)
+	if err != nil {
+		log.Fatalf("error encrypting the keys: %s", err)
+	}
+	if len(keyIds) == 0 {
+		fmt.Println("no keys stored in clear")
+		return
+	}
+	fmt.Printf("encrypted %s\n", strings.Join(keyIds, ", "))
+}
+
+// requestCertificate prints the request of a certificate for the device key,
+// with the names told by the arguments
+func requestCertificate(args []string) {
+	flags := flag.NewFlagSet("request-certificate", flag.ExitOnError)
+	commonName := flags.String("cn", "", "common name of the subject, the kid of the device key if missing")
+	serialNumber := flags.String("serial", "", "serial number of the device")
+	organization := flags.String("o", "", "comma separated organizations of the subject")
+	organizationalUnit := flags.String("ou", "", "comma separated organizational units of the subject")
+	locality := flags.String("l", "", "comma separated localities of the subject")
+	country := flags.String("c", "", "comma separated countries of the subject")
+	hosts := flags.String("hosts", strings.Join(settings.Server.TLS.Hosts, ","), "comma separated DNS names and IP addresses")
+	uris := flags.String("uris", "", "comma separated URIs, besides the DID of the device")
+	emails := flags.String("emails", "", "comma separated email addresses")
+	_ = flags.Parse(args)
 
-	router := sw.NewRouter()
+	request, err := crypto.CertificateRequest(crypto.CertificateNames{
+		CommonName:         *commonName,
+		SerialNumber:       *serialNumber,
+		Organization:       splitList(*organization),
+		OrganizationalUnit: splitList(*organizationalUnit),
+		Locality:           splitList(*locality),
+		Country:            splitList(*country),
+		Hosts:              splitList(*hosts),
+		URIs:               splitList(*uris),
+		Emails:             splitList(*emails),
+	})
+	if err != nil {
+		log.Fatalf("error requesting the certificate: %s", err)
+	}
+	fmt.Print(request)
+}
+
+// installCertificate stores the PEM chain of the file, issued for the device key
+func installCertificate(file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chain, err := crypto.InstallCertificateChain(data)
+	if err != nil {
+		log.Fatalf("error installing the certificate: %s", err)
+	}
+	fmt.Printf("chain of %d certificates installed\n", len(chain))
+}
+
+// splitList splits the comma separated list, empty if the list is
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// createAPIKey creates an API key as told by the arguments, and prints its token
+func createAPIKey(args []string) {
+	flags := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	label := flags.String("label", "", "description of the key, e.g. who it's given to")
+	scopes := flags.String("scopes", "", "comma separated scopes of the key: "+strings.Join(auth.Scopes, ", "))
+	expires := flags.Duration("expires", 0, "validity of the key, 0 for ever")
+	_ = flags.Parse(args)
+
+	var expiresAt int64
+	if *expires > 0 {
+		expiresAt = time.Now().Add(*expires).Unix()
+	}
+	issued, err := auth.Keys().Create(*label, strings.Split(*scopes, ","), expiresAt)
+	if err != nil {
+		log.Fatalf("error creating the API key: %s", err)
+	}
+	fmt.Printf("API key %s created, its token is shown only once:\n", issued.Id)
+	fmt.Println(issued.Token)
+}
+
+func listAPIKeys() {
+	for _, key := range auth.Keys().List() {
+		expiry := "never expires"
+		if key.ExpiresAt != 0 {
+			expiry = "expires " + time.Unix(key.ExpiresAt, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", key.Id, key.Label, strings.Join(key.Scopes, ","), expiry)
+	}
+}
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+// rotateAPIKey gives the API key a new token, and prints it
+func rotateAPIKey(id string) {
+	issued, err := auth.Keys().Rotate(id)
+	if err != nil {
+		log.Fatalf("error rotating the API key: %s", err)
+	}
+	fmt.Printf("API key %s rotated, its new token is shown only once:\n", issued.Id)
+	fmt.Println(issued.Token)
 }
@@ -0,0 +1,81 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"github.com/TeoSocs/alisi-client/crypto"
+	"io/ioutil"
+	"net/http"
+)
+
+// the largest certificate chain accepted
+const maxChainSize = 1 << 20
+
+// GetCertificate serves the certificate chain installed for the device key, as PEM
+func GetCertificate(w http.ResponseWriter, r *http.Request) {
+	chain, err := crypto.CertificateChain()
+	if err != nil {
+		log.Errorf("error reading the certificate chain: %v", err)
+		errorProblem(w, r, err, "error reading the certificate chain")
+		return
+	}
+	writePEM(w, "application/pem-certificate-chain", crypto.EncodeCertificateChain(chain))
+}
+
+// PutCertificate installs the PEM certificate chain issued for the device key
+func PutCertificate(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxChainSize))
+	if err != nil {
+		log.Errorf("error reading body: %v", err)
+		problem(w, r, http.StatusBadRequest, "can't read body")
+		return
+	}
+
+	chain, err := crypto.InstallCertificateChain(body)
+	if err != nil {
+		log.Errorf("certificate chain refused: %s", err)
+		errorProblem(w, r, err, "error installing the certificate chain")
+		return
+	}
+	audit(r, "certificate chain installed")
+	writePEM(w, "application/pem-certificate-chain", crypto.EncodeCertificateChain(chain))
+}
+
+// GetCertificateRequest serves a PKCS #10 request of a certificate for the
+// device key, with the names given in the query
+func GetCertificateRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	request, err := crypto.CertificateRequest(crypto.CertificateNames{
+		CommonName:         query.Get("cn"),
+		SerialNumber:       query.Get("serialNumber"),
+		Organization:       query["o"],
+		OrganizationalUnit: query["ou"],
+		Locality:           query["l"],
+		Country:            query["c"],
+		Hosts:              query["host"],
+		URIs:               query["uri"],
+		Emails:             query["email"],
+	})
+	if err != nil {
+		log.Errorf("error requesting the certificate: %s", err)
+		errorProblem(w, r, err, "error requesting the certificate")
+		return
+	}
+	writePEM(w, "application/pkcs10", []byte(request))
+}
+
+func writePEM(w http.ResponseWriter, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		log.Errorf("error writing PEM: %v", err)
+	}
+}
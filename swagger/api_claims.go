@@ -11,38 +11,24 @@
 package swagger
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"github.com/TeoSocs/alisi-client/crypto"
+	"fmt"
 	"github.com/TeoSocs/alisi-client/datamodel"
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const TEST_API_KEY = "testAPIkey"
-
-func checkAuth(w http.ResponseWriter, r *http.Request) (err error) {
-	if r.Header.Get("X-API-Key") != TEST_API_KEY {
-		http.Error(w, "API key is missing or invalid", http.StatusUnauthorized)
-		w.Header().Add("WWW-Authenticate", `Basic realm="Access to the ALISI device"`)
-		err = errors.New("API key is missing or invalid")
-	}
-	return
-}
-
-func CreateClaim(w http.ResponseWriter, r *http.Request) {
-	if err := checkAuth(w, r); err != nil {
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-
+func (s *Server) CreateClaim(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Errorf("error reading body: %v", err)
-		http.Error(w, "can't read body", http.StatusBadRequest)
+		problem(w, r, http.StatusBadRequest, "can't read body")
 		return
 	}
 
@@ -51,54 +37,87 @@ func CreateClaim(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		log.Errorf("error reading encodedClaim: %v", err)
-		http.Error(w, "can't read encodedClaim", http.StatusBadRequest)
+		problem(w, r, http.StatusBadRequest, "can't read encodedClaim")
 		return
 	}
 
-	err = encodedClaim.CreateAndStore()
+	err = encodedClaim.CreateAndStore(s.Claims)
 	if err != nil {
 		log.Errorf("error storing encodedClaim: %v", err)
-		message := "the claim " + encodedClaim.Id + " already exists"
-		if err.Error() == message {
-			http.Error(w, message, http.StatusBadRequest)
-			return
-		}
-		http.Error(w, "error storing encodedClaim", http.StatusInternalServerError)
+		errorProblem(w, r, err, "error storing encodedClaim")
 		return
 	}
+	audit(r, "claim %s created", encodedClaim.Id)
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Location", r.URL.Path+"/"+url.PathEscape(encodedClaim.Id))
+	w.Header().Set("ETag", encodedClaim.ETag())
+	w.WriteHeader(http.StatusCreated)
 }
 
-func DeleteClaim(w http.ResponseWriter, r *http.Request) {
-	if err := checkAuth(w, r); err != nil {
+// ReplaceClaim stores a newer claim in place of the one with the same ID, if it
+// didn't change since the client read it: its ETag must be given in If-Match
+func (s *Server) ReplaceClaim(w http.ResponseWriter, r *http.Request) {
+	claimId := mux.Vars(r)["claimID"]
+
+	etag := r.Header.Get("If-Match")
+	if etag == "" {
+		problem(w, r, http.StatusPreconditionRequired, "If-Match is required, with the ETag of the claim to replace")
+		return
+	}
+
+	var encodedClaim datamodel.EncodedClaim
+	if err := json.NewDecoder(r.Body).Decode(&encodedClaim); err != nil {
+		log.Errorf("error reading encodedClaim: %v", err)
+		problem(w, r, http.StatusBadRequest, "can't read encodedClaim")
+		return
+	}
+	if encodedClaim.Id == "" {
+		encodedClaim.Id = claimId
+	}
+	if encodedClaim.Id != claimId {
+		problem(w, r, http.StatusBadRequest, "the claim id doesn't match the path")
+		return
+	}
+
+	newETag, err := encodedClaim.Replace(s.Claims, etag)
+	if err != nil {
+		log.Errorf("error replacing %s: %v", claimId, err)
+		errorProblem(w, r, err, "error replacing claim")
 		return
 	}
+	audit(r, "claim %s replaced", claimId)
+
+	w.Header().Set("ETag", newETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) DeleteClaim(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	claimId := vars["claimID"]
 
-	if err := datamodel.DeleteClaim(claimId); err != nil {
+	if err := datamodel.DeleteClaim(s.Claims, claimId); err != nil {
 		log.Errorf("error deleting %s: %s", claimId, err)
-		http.Error(w, "error deleting stored claim", http.StatusBadRequest)
+		errorProblem(w, r, err, "error deleting stored claim")
 		return
 	}
+	audit(r, "claim %s deleted", claimId)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 }
 
-func GetClaimByID(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetClaimByID(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	claimId := vars["claimID"]
 
-	claim, err := datamodel.GetClaim(claimId)
+	claim, etag, err := datamodel.GetClaim(s.Claims, claimId)
 	if err != nil {
 		log.Errorf("error retrieving %s: %s", claimId, err)
-		// TODO maybe check different errors
-		http.Error(w, "error retrieving claim", http.StatusBadRequest)
+		errorProblem(w, r, err, "error retrieving claim")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("ETag", etag)
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(claim)
 	if err != nil {
@@ -107,61 +126,175 @@ func GetClaimByID(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func RequestSigned(w http.ResponseWriter, req *http.Request) {
-	//TODO
-	vars := mux.Vars(req)
-	claimId := vars["claimID"]
-	nonce := vars["nonce"]
-	log.Debugf("nonce received: %s", nonce)
-	claim, err := datamodel.GetEncoded(claimId)
+// GetClaimHistory returns the retained versions of the claim, deleted claims included
+func (s *Server) GetClaimHistory(w http.ResponseWriter, r *http.Request) {
+	claimId := mux.Vars(r)["claimID"]
 
+	history, err := datamodel.GetHistory(s.Claims, claimId)
 	if err != nil {
-		log.Errorf("error retrieving %s: %s", claimId, err)
-		// TODO maybe check different errors
-		http.Error(w, "error retrieving claim", http.StatusBadRequest)
+		log.Errorf("error retrieving the history of %s: %s", claimId, err)
+		errorProblem(w, r, err, "error retrieving claim history")
 		return
 	}
+	writeJSON(w, history)
+}
 
-	// now I have to sign the encodedClaim
-	r, s, err := crypto.Sign(nonce)
-	if err != nil {
-		log.Errorf("error signing %s: %s", claimId, err)
-		http.Error(w, "error signing claim", http.StatusInternalServerError)
+func (s *Server) GetClaimVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claimId := vars["claimID"]
+
+	n, err := strconv.Atoi(vars["version"])
+	if err != nil || n < 1 {
+		problem(w, r, http.StatusBadRequest, "the version must be a positive integer")
 		return
 	}
-	derEncoding, err := crypto.EncodeSignatureDER(r, s)
+	version, err := datamodel.GetVersion(s.Claims, claimId, n)
 	if err != nil {
-		log.Errorf("error encoding signature: &v", err)
-		http.Error(w, "internal error during DER encoding", http.StatusInternalServerError)
+		log.Errorf("error retrieving version %d of %s: %s", n, claimId, err)
+		errorProblem(w, r, err, "error retrieving claim version")
+		return
 	}
+	writeJSON(w, version)
+}
 
-	claim.Signature = base64.StdEncoding.EncodeToString(derEncoding)
-	//claim.Signature = string(derEncoding)map
+func (s *Server) IssueChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := s.challenges.Issue()
+	if err != nil {
+		log.Errorf("error issuing challenge: %v", err)
+		errorProblem(w, r, err, "error issuing challenge")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(claim)
+	err = json.NewEncoder(w).Encode(challenge)
 	if err != nil {
 		log.Errorf("error encoding JSON: %v", err)
 	}
-	return
 }
 
-func GetClaimList(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+func (s *Server) RequestSigned(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	claimId := vars["claimID"]
+
+	var presentation datamodel.PresentationRequest
+	if err := json.NewDecoder(req.Body).Decode(&presentation); err != nil {
+		log.Errorf("error reading presentation request: %v", err)
+		problem(w, req, http.StatusBadRequest, "can't read presentation request")
+		return
+	}
+	if presentation.Nonce == "" || presentation.Verifier == "" {
+		problem(w, req, http.StatusBadRequest, "nonce and verifier are required")
+		return
+	}
+	log.Debugf("nonce received from %s: %s", presentation.Verifier, presentation.Nonce)
+
+	claim, err := datamodel.GetEncoded(s.Claims, claimId)
+	if err != nil {
+		log.Errorf("error retrieving %s: %s", claimId, err)
+		errorProblem(w, req, err, "error retrieving claim")
+		return
+	}
+	// the same checks as reading the claim: an issuer may be removed after storing it
+	if err = claim.CheckTrust(); err != nil {
+		log.Errorf("refusing to sign %s: %s", claimId, err)
+		errorProblem(w, req, err, "error retrieving claim")
+		return
+	}
+	if err = claim.ValidAt(time.Now()); err != nil {
+		log.Errorf("refusing to sign %s: %s", claimId, err)
+		errorProblem(w, req, err, "error retrieving claim")
+		return
+	}
+	if err = datamodel.Revocations().Check(claim); err != nil {
+		log.Errorf("refusing to sign %s: %s", claimId, err)
+		errorProblem(w, req, err, "error retrieving claim")
+		return
+	}
 
-	claimList, err := datamodel.GetClaimList()
+	// the nonce is consumed only for existing, valid and not revoked claims, not to waste it on typos
+	if err = s.challenges.Consume(presentation.Nonce); err != nil {
+		log.Errorf("nonce refused: %s", err)
+		errorProblem(w, req, err, "error checking the nonce")
+		return
+	}
 
+	signed, err := claim.Attest(presentation.Nonce, presentation.Verifier)
 	if err != nil {
-		log.Errorf("error reading claim list: %v", err)
-		http.Error(w, "can't retrieve claim list", http.StatusInternalServerError)
+		log.Errorf("error signing %s: %s", claimId, err)
+		problem(w, req, http.StatusInternalServerError, "error signing claim")
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(claimList)
+	err = json.NewEncoder(w).Encode(signed)
 	if err != nil {
 		log.Errorf("error encoding JSON: %v", err)
 	}
 	return
 }
+
+// GetClaimList lists the claims the query parameters select, a page at a time.
+// The following page is linked in the Link header.
+func (s *Server) GetClaimList(w http.ResponseWriter, r *http.Request) {
+	query, err := claimQuery(r.URL.Query())
+	if err != nil {
+		problem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := datamodel.ListClaims(s.Claims, query)
+	if err != nil {
+		log.Errorf("error reading claim list: %v", err)
+		errorProblem(w, r, err, "can't retrieve claim list")
+		return
+	}
+
+	if page.NextCursor != "" {
+		next := r.URL.Query()
+		next.Set("cursor", page.NextCursor)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	writeJSON(w, page.Claims)
+}
+
+// claimQuery reads the filters, the order and the page of the claim list
+func claimQuery(values url.Values) (query datamodel.ClaimQuery, err error) {
+	query.Iss = values.Get("iss")
+	query.Sub = values.Get("sub")
+	query.Status = values.Get("status")
+	query.Cursor = values.Get("cursor")
+	query.SortBy = strings.TrimPrefix(values.Get("sort"), "-")
+	query.Descending = strings.HasPrefix(values.Get("sort"), "-")
+	if query.IssuedAfter, err = int64Parameter(values, "issuedAfter"); err != nil {
+		return
+	}
+	if query.IssuedBefore, err = int64Parameter(values, "issuedBefore"); err != nil {
+		return
+	}
+	limit, err := int64Parameter(values, "limit")
+	if err != nil {
+		return
+	}
+	if limit < 0 {
+		err = errors.New("limit must be positive")
+		return
+	}
+	query.Limit = int(limit)
+	return
+}
+
+// int64Parameter reads the integer query parameter, 0 if missing
+func int64Parameter(values url.Values, name string) (int64, error) {
+	value := values.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer", name)
+	}
+	return number, nil
+}
@@ -11,21 +11,159 @@
 package swagger
 
 import (
+	"encoding/json"
 	"github.com/TeoSocs/alisi-client/crypto"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// GetPublicKey serves the device key as PEM, or as JWK or DER according to the Accept header
 func GetPublicKey(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	publicKey, err := crypto.GetPublicKey()
 	if err != nil {
 		log.Errorf("error retrieving public key: %v", err)
-		http.Error(w, "error retrieving public key", http.StatusInternalServerError)
+		problem(w, r, http.StatusInternalServerError, "error retrieving public key")
+		return
+	}
+
+	var contentType string
+	var body []byte
+	switch negotiateKeyFormat(r.Header.Get("Accept")) {
+	case "pem":
+		contentType = "application/x-pem-file"
+		body = []byte(crypto.EncodePublicKeyToPem(publicKey))
+	case "jwk":
+		contentType = "application/jwk+json"
+		var jwk string
+		jwk, err = crypto.EncodePublicKeyToJWK(publicKey)
+		body = []byte(jwk)
+	case "der":
+		contentType = "application/octet-stream"
+		body, err = crypto.EncodePublicKeyToDER(publicKey)
+	default:
+		problem(w, r, http.StatusNotAcceptable, "supported formats: application/x-pem-file, application/jwk+json, application/octet-stream")
 		return
 	}
+	if err != nil {
+		log.Errorf("error encoding pubKey: %v", err)
+		problem(w, r, http.StatusInternalServerError, "error encoding public key")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Key-Id", crypto.KeyId(publicKey))
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(crypto.EncodePublicKeyToPem(publicKey)))
+	_, err = w.Write(body)
 	if err != nil {
 		log.Errorf("error encoding pubKey: %v", err)
 	}
 }
+
+// negotiateKeyFormat returns the key format the client prefers, by q-value and then
+// by order, PEM if it accepts anything. Media ranges with q=0 are refused.
+func negotiateKeyFormat(accept string) (format string) {
+	if accept == "" {
+		return "pem"
+	}
+	best := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			pair := strings.SplitN(param, "=", 2)
+			if len(pair) != 2 || !strings.EqualFold(strings.TrimSpace(pair[0]), "q") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(pair[1]), 64)
+			if err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+			quality = q
+		}
+		// on ties the first media range wins
+		if quality <= best {
+			continue
+		}
+		var candidate string
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "application/x-pem-file", "text/plain", "text/*", "*/*":
+			candidate = "pem"
+		case "application/jwk+json", "application/json":
+			candidate = "jwk"
+		case "application/octet-stream":
+			candidate = "der"
+		default:
+			continue
+		}
+		format, best = candidate, quality
+	}
+	return
+}
+
+// GetJWKS serves the current and the retired device keys as a JWK Set
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := crypto.DeviceJWKSet()
+	if err != nil {
+		log.Errorf("error retrieving public keys: %v", err)
+		problem(w, r, http.StatusInternalServerError, "error retrieving public keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(set)
+	if err != nil {
+		log.Errorf("error encoding JSON: %v", err)
+	}
+}
+
+func RotateKey(w http.ResponseWriter, r *http.Request) {
+	retired, err := crypto.RotateKey()
+	if err != nil {
+		log.Errorf("error rotating the key: %v", err)
+		problem(w, r, http.StatusInternalServerError, "error rotating the key")
+		return
+	}
+	audit(r, "device key %s rotated", retired.KeyId)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(retired)
+	if err != nil {
+		log.Errorf("error encoding JSON: %v", err)
+	}
+}
+
+func GetKeyHandover(w http.ResponseWriter, r *http.Request) {
+	retiredKeys, err := crypto.RetiredKeys()
+	if err != nil {
+		log.Errorf("error reading retired keys: %v", err)
+		problem(w, r, http.StatusInternalServerError, "error reading retired keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(retiredKeys)
+	if err != nil {
+		log.Errorf("error encoding JSON: %v", err)
+	}
+}
+
+// GetDIDDocument serves the DID Document of the device did:key
+func GetDIDDocument(w http.ResponseWriter, r *http.Request) {
+	document, err := crypto.DeviceDIDDocument()
+	if err != nil {
+		log.Errorf("error building the DID Document: %v", err)
+		problem(w, r, http.StatusInternalServerError, "error building the DID Document")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/did+ld+json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(document)
+	if err != nil {
+		log.Errorf("error encoding JSON: %v", err)
+	}
+}
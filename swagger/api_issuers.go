@@ -0,0 +1,74 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"encoding/json"
+	"github.com/TeoSocs/alisi-client/datamodel"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func GetIssuerList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, datamodel.TrustedIssuers().List())
+}
+
+func GetIssuer(w http.ResponseWriter, r *http.Request) {
+	issuerId := mux.Vars(r)["issuerID"]
+
+	issuer, err := datamodel.TrustedIssuers().Get(issuerId)
+	if err != nil {
+		log.Errorf("error retrieving issuer %s: %s", issuerId, err)
+		errorProblem(w, r, err, "error retrieving issuer")
+		return
+	}
+	writeJSON(w, issuer)
+}
+
+// PutIssuer registers the issuer with its keys, replacing them if it's already trusted
+func PutIssuer(w http.ResponseWriter, r *http.Request) {
+	issuerId := mux.Vars(r)["issuerID"]
+
+	var issuer datamodel.Issuer
+	if err := json.NewDecoder(r.Body).Decode(&issuer); err != nil {
+		log.Errorf("error reading issuer: %v", err)
+		problem(w, r, http.StatusBadRequest, "can't read issuer")
+		return
+	}
+	if issuer.Id == "" {
+		issuer.Id = issuerId
+	}
+	if issuer.Id != issuerId {
+		problem(w, r, http.StatusBadRequest, "the issuer id doesn't match the path")
+		return
+	}
+
+	stored, err := datamodel.TrustedIssuers().Put(issuer)
+	if err != nil {
+		log.Errorf("error storing issuer %s: %s", issuerId, err)
+		errorProblem(w, r, err, "error storing issuer")
+		return
+	}
+	audit(r, "issuer %s trusted", issuerId)
+	writeJSON(w, stored)
+}
+
+func DeleteIssuer(w http.ResponseWriter, r *http.Request) {
+	issuerId := mux.Vars(r)["issuerID"]
+
+	if err := datamodel.TrustedIssuers().Delete(issuerId); err != nil {
+		log.Errorf("error deleting issuer %s: %s", issuerId, err)
+		errorProblem(w, r, err, "error deleting issuer")
+		return
+	}
+	audit(r, "issuer %s no longer trusted", issuerId)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,73 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"encoding/json"
+	"github.com/TeoSocs/alisi-client/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, auth.Keys().List())
+}
+
+// CreateAPIKey creates a key, whose token is returned only in this response
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var key auth.APIKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		log.Errorf("error reading API key: %v", err)
+		problem(w, r, http.StatusBadRequest, "can't read API key")
+		return
+	}
+
+	issued, err := auth.Keys().Create(key.Label, key.Scopes, key.ExpiresAt)
+	if err != nil {
+		log.Errorf("error creating API key: %s", err)
+		errorProblem(w, r, err, "error creating API key")
+		return
+	}
+	audit(r, "API key %s created", issued.Id)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err = json.NewEncoder(w).Encode(issued); err != nil {
+		log.Errorf("error encoding JSON: %v", err)
+	}
+}
+
+// RotateAPIKey gives the key a new token, returned only in this response
+func RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyId := mux.Vars(r)["keyID"]
+
+	issued, err := auth.Keys().Rotate(keyId)
+	if err != nil {
+		log.Errorf("error rotating API key %s: %s", keyId, err)
+		errorProblem(w, r, err, "error rotating API key")
+		return
+	}
+	audit(r, "API key %s rotated", keyId)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, issued)
+}
+
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyId := mux.Vars(r)["keyID"]
+
+	if err := auth.Keys().Revoke(keyId); err != nil {
+		log.Errorf("error revoking API key %s: %s", keyId, err)
+		errorProblem(w, r, err, "error revoking API key")
+		return
+	}
+	audit(r, "API key %s revoked", keyId)
+	w.WriteHeader(http.StatusOK)
+}
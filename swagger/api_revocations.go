@@ -0,0 +1,40 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"encoding/json"
+	"github.com/TeoSocs/alisi-client/datamodel"
+	"net/http"
+)
+
+func GetRevocationLists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, datamodel.Revocations().List())
+}
+
+// PushRevocationList stores the revocation list, replacing the older one of the same issuer
+func PushRevocationList(w http.ResponseWriter, r *http.Request) {
+	var list datamodel.RevocationList
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		log.Errorf("error reading revocation list: %v", err)
+		problem(w, r, http.StatusBadRequest, "can't read revocation list")
+		return
+	}
+
+	stored, err := datamodel.Revocations().Push(list.EncodedData)
+	if err != nil {
+		log.Errorf("revocation list refused: %s", err)
+		errorProblem(w, r, err, "error storing revocation list")
+		return
+	}
+	audit(r, "revocation list of %s stored", stored.Iss)
+	writeJSON(w, stored)
+}
@@ -0,0 +1,106 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"context"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/auth"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"net/http"
+	"strings"
+)
+
+// Public is the scope of the routes served to anyone. The other routes need
+// a valid API key or bearer token, granted their scope unless it's empty.
+const Public = "public"
+
+const realm = `realm="Access to the ALISI device"`
+
+type callerKey struct{}
+
+// Authorize serves the request only if its caller is granted the scope, and
+// hands the caller to the inner handler
+func Authorize(inner http.Handler, scope string) http.Handler {
+	if scope == Public {
+		return inner
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, bearer, err := authenticate(r)
+		if err != nil {
+			log.Warningf("request %s refused: %s", requestId(r), err)
+			// the header must be set before the response is written
+			if bearer {
+				w.Header().Add("WWW-Authenticate", `Bearer `+realm+`, error="invalid_token"`)
+			} else {
+				w.Header().Add("WWW-Authenticate", `Basic `+realm)
+				w.Header().Add("WWW-Authenticate", `Bearer `+realm)
+			}
+			problem(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !caller.Allows(scope) {
+			log.Warningf("%s refused: not granted the scope %s", caller, scope)
+			if bearer {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer %s, error="insufficient_scope", scope="%s"`, realm, scope))
+			}
+			errorProblem(w, r, fmt.Errorf("%w %s", auth.ErrMissingScope, scope), "")
+			return
+		}
+		log.Debugf("request %s authorized for %s", requestId(r), caller)
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+	})
+}
+
+// authenticate returns the caller of the request, identified by the bearer
+// token in Authorization if any, or by the X-API-Key, or by the client
+// certificate if it's verified and no API key is given
+func authenticate(r *http.Request) (caller auth.Caller, bearer bool, err error) {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		audiences, err := deviceAudiences()
+		if err != nil {
+			return caller, true, err
+		}
+		caller, err = auth.ControlUnits().Verify(strings.TrimSpace(header[len("Bearer "):]), audiences)
+		return caller, true, err
+	}
+	if r.Header.Get("X-API-Key") == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return auth.ControlUnits().CertificateCaller(r.TLS.VerifiedChains[0][0]), false, nil
+	}
+	key, err := auth.Keys().Authenticate(r.Header.Get("X-API-Key"))
+	return key.Caller(), false, err
+}
+
+// deviceAudiences lists the aud a bearer token can be meant for: the DID of
+// the device or the kid of its key
+func deviceAudiences() (audiences []string, err error) {
+	did, err := crypto.DeviceDID()
+	if err != nil {
+		return
+	}
+	kid, err := crypto.CurrentKeyId()
+	if err != nil {
+		return
+	}
+	return []string{did, kid}, nil
+}
+
+// callerOf returns the caller the request was authorized for, if it's not public
+func callerOf(r *http.Request) auth.Caller {
+	caller, _ := r.Context().Value(callerKey{}).(auth.Caller)
+	return caller
+}
+
+// audit logs a change made by the request, naming its caller
+func audit(r *http.Request, format string, args ...interface{}) {
+	log.Noticef("%s by %s, request %s", fmt.Sprintf(format, args...), callerOf(r), requestId(r))
+}
@@ -11,13 +11,50 @@
 package swagger
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/op/go-logging"
 	"net/http"
+	"regexp"
 	"time"
 )
 
 var log = logging.MustGetLogger("alisi")
 
+type requestIdKey struct{}
+
+// client-chosen request IDs are kept only if they are safe to log and echo
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID tags the request with the X-Request-ID of the client, or a random
+// one, and sends it back in the response so failures can be matched to the logs
+func RequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestId.MatchString(id) {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-ID", id)
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Errorf("error generating request ID: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestId returns the ID given to the request by RequestID
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -25,11 +62,12 @@ func Logger(inner http.Handler, name string) http.Handler {
 		inner.ServeHTTP(w, r)
 
 		log.Infof(
-			"%s %s %s %s",
+			"%s %s %s %s %s",
 			r.Method,
 			r.RequestURI,
 			name,
 			time.Since(start),
+			requestId(r),
 		)
 	})
 }
@@ -0,0 +1,132 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/TeoSocs/alisi-client/auth"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"github.com/TeoSocs/alisi-client/datamodel"
+)
+
+// Problem is the body of every error response, as described by RFC 7807
+type Problem struct {
+	// Type identifies the kind of problem. It's about:blank when the status says it all
+	Type string `json:"type"`
+
+	Title string `json:"title"`
+
+	Status int `json:"status"`
+
+	// Detail explains this occurrence of the problem
+	Detail string `json:"detail,omitempty"`
+
+	// Instance is the path of the request that failed
+	Instance string `json:"instance,omitempty"`
+
+	// RequestId is also sent in the X-Request-ID header, and logged by the device
+	RequestId string `json:"requestId,omitempty"`
+}
+
+const problemTypePrefix = "urn:alisi:problem:"
+
+// problemKind describes the response to the errors wrapping err
+type problemKind struct {
+	err    error
+	status int
+	name   string
+	title  string
+}
+
+var problemKinds = []problemKind{
+	// deleted claims are not found too, so they must come first
+	{datamodel.ErrClaimDeleted, http.StatusGone, "claim-deleted", "Claim deleted"},
+	{datamodel.ErrClaimNotFound, http.StatusNotFound, "claim-not-found", "Claim not found"},
+	{datamodel.ErrVersionNotFound, http.StatusNotFound, "version-not-found", "Claim version not found"},
+	{datamodel.ErrClaimExists, http.StatusConflict, "claim-exists", "Claim ID already in use"},
+	{datamodel.ErrInvalidClaimID, http.StatusBadRequest, "invalid-claim-id", "Invalid claim ID"},
+	{datamodel.ErrMalformedClaim, http.StatusBadRequest, "malformed-claim", "Malformed claim"},
+	{datamodel.ErrSignatureInvalid, http.StatusUnprocessableEntity, "invalid-signature", "Invalid claim signature"},
+	{datamodel.ErrUntrustedIssuer, http.StatusUnprocessableEntity, "untrusted-issuer", "Untrusted issuer"},
+	{datamodel.ErrWrongSubject, http.StatusUnprocessableEntity, "wrong-subject", "The claim is not about this device"},
+	{datamodel.ErrClaimExpired, http.StatusUnprocessableEntity, "claim-expired", "Claim expired"},
+	{datamodel.ErrClaimNotYetValid, http.StatusUnprocessableEntity, "claim-not-yet-valid", "Claim not valid yet"},
+	{datamodel.ErrClaimRevoked, http.StatusUnprocessableEntity, "claim-revoked", "Claim revoked"},
+	{datamodel.ErrETagMismatch, http.StatusPreconditionFailed, "etag-mismatch", "The claim has been modified"},
+	{datamodel.ErrStaleClaim, http.StatusConflict, "stale-claim", "The claim is not newer than the stored one"},
+	{datamodel.ErrInvalidQuery, http.StatusBadRequest, "invalid-query", "Invalid claim query"},
+	{datamodel.ErrNonceInvalid, http.StatusBadRequest, "invalid-nonce", "Invalid nonce"},
+	{datamodel.ErrNonceExpired, http.StatusBadRequest, "nonce-expired", "Nonce expired"},
+	{datamodel.ErrNonceReplayed, http.StatusConflict, "nonce-replayed", "Nonce already signed"},
+	{datamodel.ErrTooManyChallenges, http.StatusServiceUnavailable, "too-many-challenges", "Too many outstanding challenges"},
+	{datamodel.ErrIssuerNotFound, http.StatusNotFound, "issuer-not-found", "Issuer not found"},
+	{datamodel.ErrInvalidIssuer, http.StatusBadRequest, "invalid-issuer", "Invalid issuer"},
+	{datamodel.ErrInvalidRevocationList, http.StatusBadRequest, "invalid-revocation-list", "Invalid revocation list"},
+	{datamodel.ErrStaleRevocationList, http.StatusConflict, "stale-revocation-list", "The revocation list is not newer than the stored one"},
+	{crypto.ErrNoCertificate, http.StatusNotFound, "certificate-not-found", "No certificate installed for the device key"},
+	{crypto.ErrInvalidCertificate, http.StatusBadRequest, "invalid-certificate", "Invalid certificate chain"},
+	{crypto.ErrInvalidCertificateName, http.StatusBadRequest, "invalid-certificate-name", "Invalid certificate name"},
+	{auth.ErrMissingScope, http.StatusForbidden, "insufficient-scope", "The caller is not granted the scope"},
+	{auth.ErrKeyNotFound, http.StatusNotFound, "api-key-not-found", "API key not found"},
+	{auth.ErrInvalidScope, http.StatusBadRequest, "invalid-scope", "Invalid scope"},
+}
+
+// writeProblem sends the problem, filling the fields that come from the request
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	p.Instance = r.URL.Path
+	p.RequestId = requestId(r)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Errorf("error encoding problem: %v", err)
+	}
+}
+
+// problem replies with a problem described by its status only
+func problem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblem(w, r, Problem{Status: status, Detail: detail})
+}
+
+// errorProblem replies with the problem err is about. Errors of unknown kind
+// are internal: they are not detailed to the client, that gets the message instead.
+func errorProblem(w http.ResponseWriter, r *http.Request, err error, message string) {
+	for _, kind := range problemKinds {
+		if errors.Is(err, kind.err) {
+			writeProblem(w, r, Problem{
+				Type:   problemTypePrefix + kind.name,
+				Title:  kind.title,
+				Status: kind.status,
+				Detail: err.Error(),
+			})
+			return
+		}
+	}
+	problem(w, r, http.StatusInternalServerError, message)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	problem(w, r, http.StatusNotFound, "no such resource")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	problem(w, r, http.StatusMethodNotAllowed, r.Method+" is not supported by this resource")
+}
@@ -11,35 +11,71 @@
 package swagger
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/TeoSocs/alisi-client/auth"
+	"github.com/TeoSocs/alisi-client/datamodel"
 	"github.com/gorilla/mux"
 )
 
 type Route struct {
-	Name        string
-	Method      string
-	Pattern     string
+	Name    string
+	Method  string
+	Pattern string
+
+	// Scope the caller must be granted, Public for routes served to anyone
+	// or empty for any caller with a valid API key or bearer token
+	Scope       string
 	HandlerFunc http.HandlerFunc
 }
 
 type Routes []Route
 
-func NewRouter() *mux.Router {
+// Server serves the API on top of the claim store it's given
+type Server struct {
+	Claims datamodel.ClaimStore
+
+	// challenges tracks the nonces the device has issued or already signed
+	challenges *datamodel.ChallengeRegistry
+}
+
+// maxChallenges caps the unexpired nonces issued by /challenge, open to anyone
+const maxChallenges = 1000
+
+func NewServer(claims datamodel.ClaimStore) *Server {
+	return &Server{
+		Claims:     claims,
+		challenges: datamodel.NewChallengeRegistry(5*time.Minute, maxChallenges),
+	}
+}
+
+func NewRouter(claims datamodel.ClaimStore) *mux.Router {
+	return NewServer(claims).Router()
+}
+
+func (s *Server) Router() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
+	for _, route := range s.routes() {
 		var handler http.Handler
 		handler = route.HandlerFunc
+		handler = Authorize(handler, route.Scope)
 		handler = Logger(handler, route.Name)
+		handler = RequestID(handler)
 
+		// the path is matched first, or a route with another path but the
+		// same method hides that the method is not allowed
 		router.
-			Methods(route.Method).
 			Path(route.Pattern).
+			Methods(route.Method).
 			Name(route.Name).
 			Handler(handler)
 	}
+	router.NotFoundHandler = RequestID(Logger(http.HandlerFunc(notFound), "NotFound"))
+	router.MethodNotAllowedHandler = RequestID(Logger(http.HandlerFunc(methodNotAllowed), "MethodNotAllowed"))
 
 	return router
 }
@@ -48,53 +84,239 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello World!")
 }
 
-var routes = Routes{
-	Route{
-		"Index",
-		"GET",
-		"/alisi/v1/",
-		Index,
-	},
-
-	Route{
-		"CreateClaim",
-		strings.ToUpper("Post"),
-		"/alisi/v1/claim",
-		CreateClaim,
-	},
-
-	Route{
-		"DeleteClaim",
-		strings.ToUpper("Delete"),
-		"/alisi/v1/claim/{claimID}",
-		DeleteClaim,
-	},
-
-	Route{
-		"GetClaimByID",
-		strings.ToUpper("Get"),
-		"/alisi/v1/claim/{claimID}",
-		GetClaimByID,
-	},
-
-	Route{
-		"GetClaimList",
-		strings.ToUpper("Get"),
-		"/alisi/v1/claim",
-		GetClaimList,
-	},
-
-	Route{
-		"RequestSigned",
-		strings.ToUpper("Post"),
-		"/alisi/v1/claim/{claimID}/request_signed/{nonce}",
-		RequestSigned,
-	},
-
-	Route{
-		"GetPublicKey",
-		strings.ToUpper("Get"),
-		"/alisi/v1/public_key",
-		GetPublicKey,
-	},
+// writeJSON replies 200 with the value as JSON
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("error encoding JSON: %v", err)
+	}
+}
+
+func (s *Server) routes() Routes {
+	return Routes{
+		Route{
+			"Index",
+			"GET",
+			"/alisi/v1/",
+			Public,
+			Index,
+		},
+
+		Route{
+			"CreateClaim",
+			strings.ToUpper("Post"),
+			"/alisi/v1/claim",
+			auth.ScopeClaimsWrite,
+			s.CreateClaim,
+		},
+
+		Route{
+			"DeleteClaim",
+			strings.ToUpper("Delete"),
+			"/alisi/v1/claim/{claimID}",
+			auth.ScopeClaimsDelete,
+			s.DeleteClaim,
+		},
+
+		Route{
+			"ReplaceClaim",
+			strings.ToUpper("Put"),
+			"/alisi/v1/claim/{claimID}",
+			auth.ScopeClaimsWrite,
+			s.ReplaceClaim,
+		},
+
+		Route{
+			"GetClaimByID",
+			strings.ToUpper("Get"),
+			"/alisi/v1/claim/{claimID}",
+			Public,
+			s.GetClaimByID,
+		},
+
+		Route{
+			"GetClaimList",
+			strings.ToUpper("Get"),
+			"/alisi/v1/claim",
+			Public,
+			s.GetClaimList,
+		},
+
+		Route{
+			"GetClaimHistory",
+			strings.ToUpper("Get"),
+			"/alisi/v1/claim/{claimID}/history",
+			"",
+			s.GetClaimHistory,
+		},
+
+		Route{
+			"GetClaimVersion",
+			strings.ToUpper("Get"),
+			"/alisi/v1/claim/{claimID}/versions/{version}",
+			"",
+			s.GetClaimVersion,
+		},
+
+		Route{
+			"RequestSigned",
+			strings.ToUpper("Post"),
+			"/alisi/v1/claim/{claimID}/request_signed",
+			Public,
+			s.RequestSigned,
+		},
+
+		Route{
+			"IssueChallenge",
+			strings.ToUpper("Post"),
+			"/alisi/v1/challenge",
+			Public,
+			s.IssueChallenge,
+		},
+
+		Route{
+			"GetIssuerList",
+			strings.ToUpper("Get"),
+			"/alisi/v1/issuers",
+			"",
+			GetIssuerList,
+		},
+
+		Route{
+			"GetIssuer",
+			strings.ToUpper("Get"),
+			"/alisi/v1/issuers/{issuerID}",
+			"",
+			GetIssuer,
+		},
+
+		Route{
+			"PutIssuer",
+			strings.ToUpper("Put"),
+			"/alisi/v1/issuers/{issuerID}",
+			auth.ScopeAdmin,
+			PutIssuer,
+		},
+
+		Route{
+			"DeleteIssuer",
+			strings.ToUpper("Delete"),
+			"/alisi/v1/issuers/{issuerID}",
+			auth.ScopeAdmin,
+			DeleteIssuer,
+		},
+
+		Route{
+			"GetRevocationLists",
+			strings.ToUpper("Get"),
+			"/alisi/v1/revocations",
+			"",
+			GetRevocationLists,
+		},
+
+		Route{
+			"PushRevocationList",
+			strings.ToUpper("Post"),
+			"/alisi/v1/revocations",
+			auth.ScopeClaimsWrite,
+			PushRevocationList,
+		},
+
+		Route{
+			"GetAPIKeys",
+			strings.ToUpper("Get"),
+			"/alisi/v1/api_keys",
+			auth.ScopeAdmin,
+			GetAPIKeys,
+		},
+
+		Route{
+			"CreateAPIKey",
+			strings.ToUpper("Post"),
+			"/alisi/v1/api_keys",
+			auth.ScopeAdmin,
+			CreateAPIKey,
+		},
+
+		Route{
+			"RotateAPIKey",
+			strings.ToUpper("Post"),
+			"/alisi/v1/api_keys/{keyID}/rotate",
+			auth.ScopeAdmin,
+			RotateAPIKey,
+		},
+
+		Route{
+			"RevokeAPIKey",
+			strings.ToUpper("Delete"),
+			"/alisi/v1/api_keys/{keyID}",
+			auth.ScopeAdmin,
+			RevokeAPIKey,
+		},
+
+		Route{
+			"GetPublicKey",
+			strings.ToUpper("Get"),
+			"/alisi/v1/public_key",
+			Public,
+			GetPublicKey,
+		},
+
+		Route{
+			"GetCertificate",
+			strings.ToUpper("Get"),
+			"/alisi/v1/certificate",
+			Public,
+			GetCertificate,
+		},
+
+		Route{
+			"PutCertificate",
+			strings.ToUpper("Put"),
+			"/alisi/v1/certificate",
+			auth.ScopeAdmin,
+			PutCertificate,
+		},
+
+		Route{
+			"GetCertificateRequest",
+			strings.ToUpper("Get"),
+			"/alisi/v1/certificate/csr",
+			auth.ScopeAdmin,
+			GetCertificateRequest,
+		},
+
+		Route{
+			"RotateKey",
+			strings.ToUpper("Post"),
+			"/alisi/v1/keys/rotate",
+			auth.ScopeKeysRotate,
+			RotateKey,
+		},
+
+		Route{
+			"GetKeyHandover",
+			strings.ToUpper("Get"),
+			"/alisi/v1/keys/handover",
+			Public,
+			GetKeyHandover,
+		},
+
+		Route{
+			"GetJWKS",
+			strings.ToUpper("Get"),
+			"/.well-known/jwks.json",
+			Public,
+			GetJWKS,
+		},
+
+		Route{
+			"GetDIDDocument",
+			strings.ToUpper("Get"),
+			"/alisi/v1/did",
+			Public,
+			GetDIDDocument,
+		},
+	}
 }
@@ -0,0 +1,75 @@
+/*
+ * ALISI client
+ *
+ * This is the client API of ALISI. Each device will expose this API in order to be identified by ALISI compliant control units.
+ *
+ * API version: 1.0.0
+ * Contact: matteo.sovilla@studenti.unipd.it
+ * Generated by: Swagger Codegen (https://github.com/swagger-api/swagger-codegen.git)
+ */
+
+package swagger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/TeoSocs/alisi-client/config"
+	"github.com/TeoSocs/alisi-client/crypto"
+	"io/ioutil"
+	"net/http"
+)
+
+// ListenAndServe serves the handler on the address of the settings, over TLS
+// if enabled. It returns only on failure.
+func ListenAndServe(settings config.Server, handler http.Handler) error {
+	if !settings.TLS.Enabled {
+		log.Warningf("serving the API on %s without TLS", settings.Listen)
+		return http.ListenAndServe(settings.Listen, handler)
+	}
+	tlsConfig, err := TLSConfig(settings.TLS)
+	if err != nil {
+		return fmt.Errorf("can't serve the API over TLS: %w", err)
+	}
+	log.Infof("serving the API on %s over TLS", settings.Listen)
+	server := &http.Server{Addr: settings.Listen, Handler: handler, TLSConfig: tlsConfig}
+	return server.ListenAndServeTLS("", "")
+}
+
+// TLSConfig serves the certificate of the device key, and verifies the client
+// certificates against the CAs of the settings
+func TLSConfig(settings config.TLS) (tlsConfig *tls.Config, err error) {
+	certificates := &crypto.DeviceCertificates{Hosts: settings.Hosts}
+	if settings.Chain != "" {
+		data, err := ioutil.ReadFile(settings.Chain)
+		if err != nil {
+			return nil, err
+		}
+		if certificates.Chain, err = crypto.DecodeCertificateChain(data); err != nil {
+			return nil, fmt.Errorf("invalid certificate chain %s: %w", settings.Chain, err)
+		}
+	}
+	if _, err = certificates.Certificate(); err != nil {
+		return
+	}
+	tlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificates.GetCertificate,
+	}
+	if settings.ClientCA == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(settings.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", settings.ClientCA)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if settings.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}